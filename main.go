@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	_ "log"
 	"time"
@@ -34,14 +35,18 @@ func (chat Chat) HiArray(arr []int) bool {
 	return true
 }
 
-func (chat Chat) HiStream(msg string) chan string {
+func (chat Chat) HiStream(ctx context.Context, msg string) chan string {
 	ch := make(chan string)
 	go func() {
+		defer close(ch)
 		for i := 0; i < 20; i++ {
 			time.Sleep(1 * time.Second)
-			ch <- msg
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(ch)
 	}()
 	return ch
 }
@@ -61,6 +66,8 @@ func main() {
 	hub := &Chat{}
 	hub.Options.PingInterval = 5000 //  It's better to give a default
 	hub.Options.PingTimeout = 10000
-	server.RegisterHubs(hub)
+	if err := server.RegisterHubs(hub); err != nil {
+		log.Fatal(err)
+	}
 	server.Start()
 }
@@ -0,0 +1,207 @@
+package signalr_server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Principal is the authenticated caller of a connection.
+type Principal struct {
+	UserId string
+	Claims map[string]any
+}
+
+// Authenticator authenticates the requests to negotiate and to the hubs.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+// UserIdProvider derives the user id of a connection from its authenticated
+// request. The user id addresses the connection in Clients().User.
+type UserIdProvider interface {
+	UserId(r *http.Request, principal *Principal) string
+}
+
+// UserIdProviderFunc adapts a function to a UserIdProvider.
+type UserIdProviderFunc func(r *http.Request, principal *Principal) string
+
+func (f UserIdProviderFunc) UserId(r *http.Request, principal *Principal) string {
+	return f(r, principal)
+}
+
+// userId returns the user id of a new connection, which is the user id of the
+// principal unless the server has a UserIdProvider.
+func (s *Server) userId(r *http.Request, principal *Principal) string {
+	if s.UserIdProvider != nil {
+		return s.UserIdProvider.UserId(r, principal)
+	}
+	return principalUserId(principal)
+}
+
+func principalUserId(principal *Principal) string {
+	if principal == nil {
+		return ""
+	}
+	return principal.UserId
+}
+
+var errNoToken = errors.New("no bearer token")
+
+// BearerToken returns the token of the Authorization header, or of the
+// access_token query parameter browsers use for WebSockets and SSE.
+func BearerToken(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return authorization[7:], nil
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token, nil
+	}
+	return "", errNoToken
+}
+
+var errNoKey = errors.New("JwtAuthenticator has neither a Key nor a KeyFunc")
+
+// JwtAuthenticator validates the bearer token of a request as a JWT. Tokens
+// must carry an exp claim, like ASP.NET Core requires by default.
+type JwtAuthenticator struct {
+	// Key verifies HMAC signed tokens. It is ignored when KeyFunc is set.
+	Key []byte
+	// KeyFunc returns the key verifying a token, e.g. for RSA signed tokens.
+	KeyFunc jwt.Keyfunc
+	// Issuer and Audience are checked when they are not empty.
+	Issuer   string
+	Audience string
+	// UserIdClaim is the claim holding the user id, "sub" by default.
+	UserIdClaim string
+}
+
+func (a *JwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	tokenString, err := BearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	keyFunc := a.KeyFunc
+	if keyFunc == nil {
+		// an empty key would accept tokens anyone can sign
+		if len(a.Key) == 0 {
+			return nil, errNoKey
+		}
+		keyFunc = func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return a.Key, nil
+		}
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	// jwt only checks exp when the token has one
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("token has no expiration time")
+	}
+	if a.Issuer != "" && !claims.VerifyIssuer(a.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if a.Audience != "" && !claims.VerifyAudience(a.Audience, true) {
+		return nil, errors.New("invalid audience")
+	}
+	userIdClaim := a.UserIdClaim
+	if userIdClaim == "" {
+		userIdClaim = "sub"
+	}
+	userId, _ := claims[userIdClaim].(string)
+	return &Principal{UserId: userId, Claims: claims}, nil
+}
+
+// authenticate runs the authenticator of the server, if any, and replies 401
+// when the request can't be authenticated.
+func (hc handlerContext) authenticate(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	if hc.server.Authenticator == nil {
+		return nil, true
+	}
+	principal, err := hc.server.Authenticator.Authenticate(r)
+	if err != nil {
+		LogDebug(fmt.Sprintf("authentication failed: %v", err))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return principal, true
+}
+
+// Policy checks whether a principal may invoke a hub method.
+type Policy func(principal *Principal) error
+
+// Policies declares the policies of hub methods by method name, the "*" entry
+// applying to every method. A hub implements Authorize by calling it.
+type Policies map[string][]Policy
+
+func (p Policies) Authorize(method string, principal *Principal) error {
+	for _, key := range []string{"*", method} {
+		for _, policy := range p[key] {
+			if err := policy(principal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var errUnauthenticated = errors.New("user is not authenticated")
+
+// RequireAuthenticatedUser rejects anonymous callers.
+func RequireAuthenticatedUser(principal *Principal) error {
+	if principal == nil {
+		return errUnauthenticated
+	}
+	return nil
+}
+
+// RequireClaim rejects callers without the claim, or whose claim has none of
+// the values when any are given.
+func RequireClaim(claim string, values ...any) Policy {
+	return func(principal *Principal) error {
+		if principal == nil {
+			return errUnauthenticated
+		}
+		value, ok := principal.Claims[claim]
+		if !ok {
+			return fmt.Errorf("claim %s is missing", claim)
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		// claims like roles may hold several values
+		claimValues, ok := value.([]any)
+		if !ok {
+			claimValues = []any{value}
+		}
+		for _, claimValue := range claimValues {
+			for _, v := range values {
+				if claimValue != nil && reflect.TypeOf(claimValue).Comparable() && claimValue == v {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("claim %s has an unexpected value", claim)
+	}
+}
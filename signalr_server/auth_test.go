@@ -0,0 +1,174 @@
+package signalr_server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var testJwtKey = []byte("test-signing-key")
+
+type authTestHub struct {
+	Hub
+}
+
+func (h authTestHub) Echo(msg string) string {
+	return msg
+}
+
+func signedToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testJwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "alice",
+		"iss": "issuer",
+		"aud": "audience",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/authtesthub/negotiate", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func testAuthenticator() *JwtAuthenticator {
+	return &JwtAuthenticator{Key: testJwtKey, Issuer: "issuer", Audience: "audience"}
+}
+
+func TestJwtAuthenticatorAcceptsValidToken(t *testing.T) {
+	principal, err := testAuthenticator().Authenticate(bearerRequest(signedToken(t, validClaims())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.UserId != "alice" {
+		t.Errorf("got user id %q, want alice", principal.UserId)
+	}
+}
+
+func TestJwtAuthenticatorReadsAccessTokenQuery(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/authtesthub?access_token="+signedToken(t, validClaims()), nil)
+	if _, err := testAuthenticator().Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJwtAuthenticatorRejectsExpiredToken(t *testing.T) {
+	claims := validClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := testAuthenticator().Authenticate(bearerRequest(signedToken(t, claims))); err == nil {
+		t.Error("expired token was accepted")
+	}
+}
+
+func TestJwtAuthenticatorRejectsTokenWithoutExpiry(t *testing.T) {
+	claims := validClaims()
+	delete(claims, "exp")
+	if _, err := testAuthenticator().Authenticate(bearerRequest(signedToken(t, claims))); err == nil {
+		t.Error("token without exp was accepted")
+	}
+}
+
+func TestJwtAuthenticatorWithoutKeyRejectsEveryToken(t *testing.T) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&JwtAuthenticator{}).Authenticate(bearerRequest(token)); err != errNoKey {
+		t.Errorf("got %v, want errNoKey", err)
+	}
+}
+
+func TestJwtAuthenticatorRejectsWrongAlgorithm(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims()).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthenticator().Authenticate(bearerRequest(token)); err == nil {
+		t.Error("RS256 token was accepted by an HMAC authenticator")
+	}
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthenticator().Authenticate(bearerRequest(unsigned)); err == nil {
+		t.Error("unsigned token was accepted")
+	}
+}
+
+func TestJwtAuthenticatorRejectsWrongKey(t *testing.T) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("other-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testAuthenticator().Authenticate(bearerRequest(token)); err == nil {
+		t.Error("token signed with another key was accepted")
+	}
+}
+
+func TestJwtAuthenticatorRejectsIssuerMismatch(t *testing.T) {
+	claims := validClaims()
+	claims["iss"] = "someone-else"
+	if _, err := testAuthenticator().Authenticate(bearerRequest(signedToken(t, claims))); err == nil {
+		t.Error("token of another issuer was accepted")
+	}
+}
+
+func TestJwtAuthenticatorRejectsAudienceMismatch(t *testing.T) {
+	claims := validClaims()
+	claims["aud"] = "another-audience"
+	if _, err := testAuthenticator().Authenticate(bearerRequest(signedToken(t, claims))); err == nil {
+		t.Error("token for another audience was accepted")
+	}
+}
+
+func TestJwtAuthenticatorRejectsMissingToken(t *testing.T) {
+	if _, err := testAuthenticator().Authenticate(bearerRequest("")); err == nil {
+		t.Error("request without a token was accepted")
+	}
+}
+
+func TestNegotiateRepliesUnauthorized(t *testing.T) {
+	server := &Server{Authenticator: testAuthenticator()}
+	if err := server.RegisterHubs(&authTestHub{}); err != nil {
+		t.Fatal(err)
+	}
+	claims := validClaims()
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	for name, token := range map[string]string{"missing": "", "expired": signedToken(t, claims)} {
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, bearerRequest(token))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s token: got status %d, want 401", name, w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s token: got WWW-Authenticate %q", name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, bearerRequest(signedToken(t, validClaims())))
+	if w.Code != http.StatusOK {
+		t.Errorf("valid token: got status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package signalr_server
+
+import (
+	"fmt"
+	"testing"
+)
+
+type discardConnection struct{}
+
+func (discardConnection) send([]byte) error { return nil }
+
+func (discardConnection) read() ([]byte, error) { select {} }
+
+type broadcastPayload struct {
+	Name   string
+	Values []int
+}
+
+func newBroadcastSuite(size int) *connectionSuite {
+	suite := &connectionSuite{}
+	for i := 0; i < size; i++ {
+		var prtl protocol = &jsonProtocol{}
+		if i%2 == 1 {
+			prtl = &msgpackProtocol{}
+		}
+		id := fmt.Sprint(i)
+		ctx := &connectionCtx{
+			connectionId: id,
+			conn:         discardConnection{},
+			end:          make(chan any),
+			eCh:          make(chan error, 1),
+			outbound:     newOutboundQueue(Options{OutboundQueuePolicy: QueueDropOldest}),
+		}
+		ctx.prtl.Store(&prtl)
+		go ctx.writePump()
+		suite.Store(id, ctx)
+	}
+	return suite
+}
+
+var broadcastArgs = []any{"broadcast", broadcastPayload{Name: "payload", Values: make([]int, 64)}}
+
+// BenchmarkBroadcastPerConnection serializes the message for each connection,
+// which is what sending to a suite did before messages were shared.
+func BenchmarkBroadcastPerConnection(b *testing.B) {
+	suite := newBroadcastSuite(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		suite.forEach(func(client *connectionCtx) {
+			client.Send("receive", broadcastArgs...)
+		})
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	suite := newBroadcastSuite(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		suite.Send("receive", broadcastArgs...)
+	}
+}
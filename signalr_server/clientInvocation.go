@@ -0,0 +1,93 @@
+package signalr_server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+var errConnectionClosed = errors.New("connection closed before the client returned a result")
+
+// Invoke sends an invocation with an id to the client and waits for the
+// Completion the client replies with.
+func (ctx *connectionCtx) Invoke(c context.Context, method string, args ...any) (any, error) {
+	var result any
+	err := ctx.InvokeResult(c, &result, method, args...)
+	return result, err
+}
+
+// InvokeResult is Invoke decoding the result of the client into the value
+// result points to. A nil result discards it.
+func (ctx *connectionCtx) InvokeResult(c context.Context, result any, method string, args ...any) error {
+	if result != nil {
+		if v := reflect.ValueOf(result); v.Kind() != reflect.Pointer || v.IsNil() {
+			return errors.New("result must be a non-nil pointer")
+		}
+	}
+	prtl := ctx.protocol()
+	if prtl == nil {
+		return errors.New("connection has not completed the handshake")
+	}
+	// the "s" prefix keeps the ids apart from those of the streams the client
+	// uploads, which Completions are matched against first
+	invocationId := "s" + strconv.FormatInt(ctx.invocationSeq.Add(1), 10)
+	invocation := Invocation{
+		Type:         InvocationType,
+		InvocationId: invocationId,
+		Target:       method,
+		Arguments:    args,
+	}
+	invocationBytes, err := prtl.marshal(invocation)
+	if err != nil {
+		return err
+	}
+	resultCh := make(chan Completion, 1)
+	ctx.pending.Store(invocationId, resultCh)
+	defer ctx.pending.Delete(invocationId)
+
+	ctx.writeMsg(invocationBytes)
+	select {
+	case completion := <-resultCh:
+		return ctx.decodeClientResult(completion, result)
+	case <-ctx.end:
+		return errConnectionClosed
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// InvokeAs invokes method on the client and decodes its result as a T, like
+// InvokeAsync<T> in .NET.
+func InvokeAs[T any](ctx context.Context, client ClientTarget, method string, args ...any) (T, error) {
+	var result T
+	err := client.InvokeResult(ctx, &result, method, args...)
+	return result, err
+}
+
+func (ctx *connectionCtx) decodeClientResult(completion Completion, result any) error {
+	if completion.Error != "" {
+		return errors.New(completion.Error)
+	}
+	raw, ok := completion.Result.([]byte)
+	if !ok || result == nil {
+		return nil
+	}
+	target := reflect.ValueOf(result).Elem()
+	v, err := ctx.protocol().unmarshalArgument(raw, target.Type())
+	if err != nil {
+		return err
+	}
+	target.Set(v)
+	return nil
+}
+
+// handleCompletion hands a Completion sent by the client to the pending Invoke.
+func (ctx *connectionCtx) handleCompletion(completion Completion) {
+	resultCh, ok := ctx.pending.LoadAndDelete(completion.InvocationId)
+	if !ok {
+		LogWarning("unexpected completion for invocation "+completion.InvocationId, nil)
+		return
+	}
+	resultCh.(chan Completion) <- completion
+}
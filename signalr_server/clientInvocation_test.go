@@ -0,0 +1,58 @@
+package signalr_server
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestInvokeIdsDontCollideWithClientStreams(t *testing.T) {
+	ctx := newTestConnection("first", "")
+	ctx.streams = make(map[string]*clientStream)
+	upload := ctx.openClientStream("1", reflect.TypeOf((<-chan int)(nil)))
+
+	results := make(chan int, 1)
+	go func() {
+		result, err := InvokeAs[int](context.Background(), ctx, "GetNumber")
+		if err != nil {
+			t.Error(err)
+		}
+		results <- result
+	}()
+	frame, _ := ctx.outbound.pop()
+	var invocation Invocation
+	if err := json.Unmarshal(frame[:len(frame)-1], &invocation); err != nil {
+		t.Fatal(err)
+	}
+	if invocation.InvocationId != "s1" {
+		t.Fatalf("got invocation id %q, want s1", invocation.InvocationId)
+	}
+
+	completion, _ := json.Marshal(Completion{Type: CompletionType, InvocationId: invocation.InvocationId, Result: 42})
+	ctx.handleMessage(nil, completion)
+	if result := <-results; result != 42 {
+		t.Errorf("got %d, want 42", result)
+	}
+	if _, ok := ctx.clientStream("1"); !ok {
+		t.Error("the completion of the invocation completed the upload stream")
+	}
+	select {
+	case <-upload.done:
+		t.Error("the upload stream was released")
+	default:
+	}
+}
+
+func TestInvokeResultRejectsInvalidResults(t *testing.T) {
+	ctx := newTestConnection("first", "")
+	var nilPointer *int
+	for name, result := range map[string]any{"value": 1, "nil pointer": nilPointer} {
+		if err := ctx.InvokeResult(context.Background(), result, "GetNumber"); err == nil {
+			t.Errorf("%s: result was accepted", name)
+		}
+	}
+	if queued(ctx) != 0 {
+		t.Errorf("got %d queued messages, want none", queued(ctx))
+	}
+}
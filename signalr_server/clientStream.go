@@ -0,0 +1,111 @@
+package signalr_server
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// clientStreamBuffer is the number of stream items buffered before the
+// inbound loop waits for the hub method to read them.
+const clientStreamBuffer = 16
+
+// clientStream is a stream uploaded by the client and passed to a hub method
+// as a <-chan T parameter.
+type clientStream struct {
+	ch       reflect.Value
+	itemType reflect.Type
+	// done is closed when the hub method returns, so that the items nobody
+	// reads anymore don't block the inbound loop
+	done chan struct{}
+}
+
+// isStreamParam reports whether a hub method parameter is fed by a client
+// stream, like ChannelReader<T> in .NET.
+func isStreamParam(t reflect.Type) bool {
+	return t.Kind() == reflect.Chan && t.ChanDir() == reflect.RecvDir
+}
+
+// openClientStream registers a stream of the client. The channel of the stream
+// is only sent to and closed from the inbound goroutine.
+func (ctx *connectionCtx) openClientStream(streamId string, paramType reflect.Type) *clientStream {
+	itemType := paramType.Elem()
+	stream := &clientStream{
+		ch:       reflect.MakeChan(reflect.ChanOf(reflect.BothDir, itemType), clientStreamBuffer),
+		itemType: itemType,
+		done:     make(chan struct{}),
+	}
+	ctx.streamsLock.Lock()
+	defer ctx.streamsLock.Unlock()
+	if previous, ok := ctx.streams[streamId]; ok {
+		previous.ch.Close()
+	}
+	ctx.streams[streamId] = stream
+	return stream
+}
+
+// releaseClientStreams unregisters the streams of a hub method that returned.
+// Their channels are left open, as the inbound goroutine may be sending to them.
+func (ctx *connectionCtx) releaseClientStreams(streamIds []string, streams []*clientStream) {
+	ctx.streamsLock.Lock()
+	defer ctx.streamsLock.Unlock()
+	for i, stream := range streams {
+		close(stream.done)
+		if ctx.streams[streamIds[i]] == stream {
+			delete(ctx.streams, streamIds[i])
+		}
+	}
+}
+
+func (ctx *connectionCtx) clientStream(streamId string) (*clientStream, bool) {
+	ctx.streamsLock.Lock()
+	defer ctx.streamsLock.Unlock()
+	stream, ok := ctx.streams[streamId]
+	return stream, ok
+}
+
+func (ctx *connectionCtx) handleStreamItem(item StreamItem) {
+	stream, ok := ctx.clientStream(item.InvocationId)
+	if !ok {
+		// the hub method may have returned without reading the whole stream
+		LogDebug("dropped item of unknown stream " + item.InvocationId)
+		return
+	}
+	v, err := ctx.protocol().unmarshalArgument(item.Item.([]byte), stream.itemType)
+	if err != nil {
+		LogWarning(fmt.Sprintf("failed to decode item of stream %s", item.InvocationId), err)
+		return
+	}
+	reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: stream.ch, Send: v},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.end)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stream.done)},
+	})
+}
+
+// completeClientStream closes the stream the client has completed.
+func (ctx *connectionCtx) completeClientStream(completion Completion) {
+	if completion.Error != "" {
+		LogWarning(fmt.Sprintf("client stream %s completed with error: %s", completion.InvocationId, completion.Error), nil)
+	}
+	ctx.closeClientStreams([]string{completion.InvocationId})
+}
+
+func (ctx *connectionCtx) closeClientStreams(streamIds []string) {
+	ctx.streamsLock.Lock()
+	defer ctx.streamsLock.Unlock()
+	for _, streamId := range streamIds {
+		if stream, ok := ctx.streams[streamId]; ok {
+			stream.ch.Close()
+			delete(ctx.streams, streamId)
+		}
+	}
+}
+
+func (ctx *connectionCtx) closeAllClientStreams() {
+	ctx.streamsLock.Lock()
+	defer ctx.streamsLock.Unlock()
+	for streamId, stream := range ctx.streams {
+		stream.ch.Close()
+		delete(ctx.streams, streamId)
+	}
+}
@@ -1,35 +1,86 @@
 package signalr_server
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 )
 
+// Clients targets connections. A connection matching several criteria of a
+// target receives a message only once.
 type Clients interface {
 	All() Target
+	// AllExcept targets every connection but the given ones.
+	AllExcept(...string) Target
 	Group(string) Target
+	// Groups targets the connections of any of the groups.
+	Groups(...string) Target
+	// GroupExcept targets the connections of a group but the given ones.
+	GroupExcept(string, ...string) Target
 	Connection(string) Target
+	Client(string) ClientTarget
+	// Clients targets the given connections.
+	Clients(...string) Target
+	// User targets every connection of a user.
+	User(string) Target
+	// Users targets every connection of the users.
+	Users(...string) Target
 	AddConnectionToGroup(connection string, group string) error
 	RemoveConnectionFromGroup(connection string, group string) error
+	// AddUserToGroup adds every current and future connection of a user to a
+	// group, until RemoveUserFromGroup.
+	AddUserToGroup(user string, group string) error
+	// RemoveUserFromGroup removes a user and its current connections from a
+	// group.
+	RemoveUserFromGroup(user string, group string) error
+	// GroupMembers lists the connections of a group.
+	GroupMembers(group string) []string
+	// GroupsOfConnection lists the groups a connection belongs to.
+	GroupsOfConnection(connection string) []string
+	// GroupsOfUser lists the groups a user or any of its connections belongs to.
+	GroupsOfUser(user string) []string
+	// CloseConnection sends a Close message with reason to the connection and
+	// closes it.
+	CloseConnection(connection string, reason string, allowReconnect bool) error
+	// QueueMetrics describes the outbound queue of the connection.
+	QueueMetrics(connection string) (QueueMetrics, bool)
 	addConnection(connectionCtx *connectionCtx)
 	removeConnection(connection string)
 	getConnection(connection string) *connectionCtx
+	forEachConnection(f func(*connectionCtx))
 }
 
 type clientsImp struct {
 	clientCtxMap *connectionSuite
 	groupMap     *connectionGroup
+	userMap      *connectionIndex
 }
 
 func CreateDefaultClients() Clients {
 	return clientsImp{
 		clientCtxMap: &connectionSuite{},
-		groupMap:     &connectionGroup{},
+		groupMap:     newConnectionGroup(),
+		userMap:      newConnectionIndex(),
 	}
 }
 
 type Target interface {
 	Send(string, ...any)
+	// SendAsync sends an invocation without waiting on slow transports past
+	// ctx. It returns the error marshalling the arguments, if any, before
+	// sending to any connection, and a *SendError naming the connections the
+	// invocation could not be delivered to.
+	SendAsync(ctx context.Context, method string, args ...any) error
+}
+
+// ClientTarget is a single connection, which can also be invoked with a result.
+type ClientTarget interface {
+	Target
+	// Invoke calls method on the client and waits for the value it returns.
+	Invoke(ctx context.Context, method string, args ...any) (any, error)
+	// InvokeResult is Invoke decoding the value into what result points to.
+	InvokeResult(ctx context.Context, result any, method string, args ...any) error
 }
 
 type dummy struct {
@@ -38,16 +89,52 @@ type dummy struct {
 func (d dummy) Send(string, ...any) {
 }
 
+func (d dummy) SendAsync(context.Context, string, ...any) error {
+	return nil
+}
+
+func (d dummy) Invoke(context.Context, string, ...any) (any, error) {
+	return nil, errors.New("connection not found")
+}
+
+func (d dummy) InvokeResult(context.Context, any, string, ...any) error {
+	return errors.New("connection not found")
+}
+
 func (cImp clientsImp) All() Target {
 	return cImp.clientCtxMap
 }
 
+func (cImp clientsImp) AllExcept(excluded ...string) Target {
+	return newMultiTarget(func() []*connectionSuite {
+		return []*connectionSuite{cImp.clientCtxMap}
+	}, excluded)
+}
+
 func (cImp clientsImp) Group(group string) Target {
-	suite, ok := cImp.groupMap.Load(group)
-	if !ok {
-		return nil
+	return cImp.Groups(group)
+}
+
+func (cImp clientsImp) Groups(groups ...string) Target {
+	return newMultiTarget(cImp.groupSuites(groups), nil)
+}
+
+// groupSuites resolves groups when sending, as a group is deleted once empty
+// and created again for its next member.
+func (cImp clientsImp) groupSuites(groups []string) func() []*connectionSuite {
+	return func() []*connectionSuite {
+		suites := make([]*connectionSuite, 0, len(groups))
+		for _, group := range groups {
+			if suite := cImp.groupMap.get(group); suite != nil {
+				suites = append(suites, suite)
+			}
+		}
+		return suites
 	}
-	return suite.(*connectionSuite)
+}
+
+func (cImp clientsImp) GroupExcept(group string, excluded ...string) Target {
+	return newMultiTarget(cImp.groupSuites([]string{group}), excluded)
 }
 
 func (cImp clientsImp) Connection(connection string) Target {
@@ -58,13 +145,47 @@ func (cImp clientsImp) Connection(connection string) Target {
 	return ctx.(*connectionCtx)
 }
 
-func (cImp clientsImp) AddConnectionToGroup(connection string, group string) error {
+func (cImp clientsImp) Client(connection string) ClientTarget {
 	ctx, ok := cImp.clientCtxMap.Load(connection)
 	if !ok {
+		return dummy{}
+	}
+	return ctx.(*connectionCtx)
+}
+
+func (cImp clientsImp) Clients(connections ...string) Target {
+	suite := &connectionSuite{}
+	for _, connection := range connections {
+		if ctx, ok := cImp.clientCtxMap.Load(connection); ok {
+			suite.Store(connection, ctx)
+		}
+	}
+	return suite
+}
+
+func (cImp clientsImp) User(user string) Target {
+	return cImp.Users(user)
+}
+
+func (cImp clientsImp) Users(users ...string) Target {
+	// like groups, users are resolved when sending
+	return newMultiTarget(func() []*connectionSuite {
+		suites := make([]*connectionSuite, 0, len(users))
+		for _, user := range users {
+			if suite := cImp.userMap.get(user); suite != nil {
+				suites = append(suites, suite)
+			}
+		}
+		return suites
+	}, nil)
+}
+
+func (cImp clientsImp) AddConnectionToGroup(connection string, group string) error {
+	ctx := cImp.getConnection(connection)
+	if ctx == nil {
 		return errors.New("connection not found")
 	}
-	clientCtxMap, _ := cImp.groupMap.LoadOrStore(group, &connectionSuite{})
-	clientCtxMap.(*connectionSuite).Store(connection, ctx)
+	cImp.groupMap.add(group, ctx)
 	return nil
 }
 
@@ -73,26 +194,84 @@ func (cImp clientsImp) RemoveConnectionFromGroup(connection string, group string
 	if !ok {
 		return errors.New("connection not found")
 	}
-	suite, ok := cImp.groupMap.Load(group)
-	if !ok {
+	if !cImp.groupMap.remove(group, connection) {
 		return errors.New("group not found")
 	}
-	suite.(*connectionSuite).Delete(connection)
 	return nil
 }
 
+func (cImp clientsImp) AddUserToGroup(user string, group string) error {
+	if user == "" {
+		return errors.New("user is empty")
+	}
+	cImp.groupMap.addUser(group, user, cImp.userConnections)
+	return nil
+}
+
+func (cImp clientsImp) RemoveUserFromGroup(user string, group string) error {
+	if user == "" {
+		return errors.New("user is empty")
+	}
+	cImp.groupMap.removeUser(group, user, cImp.userConnections)
+	return nil
+}
+
+func (cImp clientsImp) GroupMembers(group string) []string {
+	return cImp.groupMap.members(group)
+}
+
+func (cImp clientsImp) GroupsOfConnection(connection string) []string {
+	return cImp.groupMap.groupsOfConnection(connection)
+}
+
+func (cImp clientsImp) GroupsOfUser(user string) []string {
+	return cImp.groupMap.groupsOfUser(user, cImp.userConnections(user))
+}
+
+// userConnections returns the live connections of a user.
+func (cImp clientsImp) userConnections(user string) []*connectionCtx {
+	var connections []*connectionCtx
+	if suite := cImp.userMap.get(user); suite != nil {
+		suite.forEach(func(ctx *connectionCtx) {
+			connections = append(connections, ctx)
+		})
+	}
+	return connections
+}
+
+func (cImp clientsImp) CloseConnection(connection string, reason string, allowReconnect bool) error {
+	ctx := cImp.getConnection(connection)
+	if ctx == nil {
+		return errors.New("connection not found")
+	}
+	ctx.abort(reason, allowReconnect)
+	return nil
+}
+
+func (cImp clientsImp) QueueMetrics(connection string) (QueueMetrics, bool) {
+	ctx := cImp.getConnection(connection)
+	if ctx == nil {
+		return QueueMetrics{}, false
+	}
+	return ctx.outbound.metrics(), true
+}
+
 // RemoveConnection
 func (cImp clientsImp) removeConnection(connection string) {
-	cImp.clientCtxMap.Delete(connection)
-	// remove connection from all groups
-	cImp.groupMap.Range(func(key, value interface{}) bool {
-		value.(*connectionSuite).Delete(connection)
-		return true
-	})
+	if value, ok := cImp.clientCtxMap.LoadAndDelete(connection); ok {
+		if userId := value.(*connectionCtx).userId; userId != "" {
+			cImp.userMap.remove(userId, connection)
+		}
+	}
+	cImp.groupMap.removeConnection(connection)
 }
 
 func (cImp clientsImp) addConnection(connectionCtx *connectionCtx) {
 	cImp.clientCtxMap.Store(connectionCtx.connectionId, connectionCtx)
+	if connectionCtx.userId != "" {
+		cImp.userMap.add(connectionCtx.userId, connectionCtx)
+		cImp.groupMap.joinUserGroups(connectionCtx)
+	}
 }
 
 func (cImp clientsImp) getConnection(connectionId string) *connectionCtx {
@@ -103,11 +282,11 @@ func (cImp clientsImp) getConnection(connectionId string) *connectionCtx {
 	}
 }
 
-type connectionSuite struct {
-	sync.Map
+func (cImp clientsImp) forEachConnection(f func(*connectionCtx)) {
+	cImp.clientCtxMap.forEach(f)
 }
 
-type connectionGroup struct {
+type connectionSuite struct {
 	sync.Map
 }
 
@@ -116,9 +295,303 @@ func (suite *connectionSuite) All() Target {
 }
 
 func (suite *connectionSuite) Send(method string, args ...any) {
+	broadcast(suite.forEach, method, args)
+}
+
+func (suite *connectionSuite) SendAsync(ctx context.Context, method string, args ...any) error {
+	return broadcastAsync(ctx, suite.forEach, method, args)
+}
+
+func (suite *connectionSuite) forEach(f func(*connectionCtx)) {
 	suite.Range(func(key, value interface{}) bool {
-		client := value.(*connectionCtx)
-		client.Send(method, args...)
+		f(value.(*connectionCtx))
 		return true
 	})
 }
+
+// multiTarget targets the union of several suites but the excluded
+// connections. The suites are resolved and read when sending, and a connection
+// in several suites receives a message only once.
+type multiTarget struct {
+	suites   func() []*connectionSuite
+	excluded map[string]bool
+}
+
+func newMultiTarget(suites func() []*connectionSuite, excluded []string) *multiTarget {
+	target := &multiTarget{suites: suites, excluded: make(map[string]bool, len(excluded))}
+	for _, connection := range excluded {
+		target.excluded[connection] = true
+	}
+	return target
+}
+
+func (target *multiTarget) Send(method string, args ...any) {
+	broadcast(target.forEach, method, args)
+}
+
+func (target *multiTarget) SendAsync(ctx context.Context, method string, args ...any) error {
+	return broadcastAsync(ctx, target.forEach, method, args)
+}
+
+func (target *multiTarget) forEach(f func(*connectionCtx)) {
+	seen := make(map[string]bool)
+	for _, suite := range target.suites() {
+		suite.forEach(func(client *connectionCtx) {
+			if target.excluded[client.connectionId] || seen[client.connectionId] {
+				return
+			}
+			seen[client.connectionId] = true
+			f(client)
+		})
+	}
+}
+
+// HubCallerClients are the Clients of a hub seen from the caller's connection.
+type HubCallerClients interface {
+	Clients
+	// Caller targets the connection of the caller.
+	Caller() ClientTarget
+	// Others targets every connection but the caller's.
+	Others() Target
+	// OthersInGroup targets the connections of a group but the caller's.
+	OthersInGroup(string) Target
+}
+
+// hubClients lets callerClients embed Clients under a name which doesn't
+// collide with the Clients method.
+type hubClients = Clients
+
+type callerClients struct {
+	hubClients
+	caller string
+}
+
+func (c callerClients) Caller() ClientTarget {
+	return c.Client(c.caller)
+}
+
+func (c callerClients) Others() Target {
+	return c.AllExcept(c.caller)
+}
+
+func (c callerClients) OthersInGroup(group string) Target {
+	return c.GroupExcept(group, c.caller)
+}
+
+// connectionIndex maps a key, like a user id, to its connections. Keys are
+// dropped once their last connection is removed.
+type connectionIndex struct {
+	lock  sync.RWMutex
+	index map[string]*connectionSuite
+}
+
+func newConnectionIndex() *connectionIndex {
+	return &connectionIndex{index: make(map[string]*connectionSuite)}
+}
+
+func (ci *connectionIndex) add(key string, ctx *connectionCtx) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	suite, ok := ci.index[key]
+	if !ok {
+		suite = &connectionSuite{}
+		ci.index[key] = suite
+	}
+	suite.Store(ctx.connectionId, ctx)
+}
+
+func (ci *connectionIndex) remove(key string, connection string) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	suite, ok := ci.index[key]
+	if !ok {
+		return
+	}
+	suite.Delete(connection)
+	if suite.isEmpty() {
+		delete(ci.index, key)
+	}
+}
+
+func (ci *connectionIndex) get(key string) *connectionSuite {
+	ci.lock.RLock()
+	defer ci.lock.RUnlock()
+	return ci.index[key]
+}
+
+func (suite *connectionSuite) isEmpty() bool {
+	empty := true
+	suite.Range(func(key, value interface{}) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+// connectionGroup indexes connections by group. Users belong to groups as well,
+// their connections join the groups when added, and their membership outlives
+// them. A group is deleted with its last connection.
+type connectionGroup struct {
+	lock   sync.RWMutex
+	groups map[string]*connectionSuite
+	// connections and users hold the groups of each connection and user
+	connections map[string]map[string]bool
+	users       map[string]map[string]bool
+}
+
+func newConnectionGroup() *connectionGroup {
+	return &connectionGroup{
+		groups:      make(map[string]*connectionSuite),
+		connections: make(map[string]map[string]bool),
+		users:       make(map[string]map[string]bool),
+	}
+}
+
+func (cg *connectionGroup) add(group string, ctx *connectionCtx) {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	cg.addLocked(group, ctx)
+}
+
+// addLocked skips ended connections, which may already be removed from every
+// group.
+func (cg *connectionGroup) addLocked(group string, ctx *connectionCtx) {
+	select {
+	case <-ctx.end:
+		return
+	default:
+	}
+	suite, ok := cg.groups[group]
+	if !ok {
+		suite = &connectionSuite{}
+		cg.groups[group] = suite
+	}
+	suite.Store(ctx.connectionId, ctx)
+	addMember(cg.connections, ctx.connectionId, group)
+}
+
+// remove reports whether the group exists.
+func (cg *connectionGroup) remove(group string, connection string) bool {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	return cg.removeLocked(group, connection)
+}
+
+func (cg *connectionGroup) removeLocked(group string, connection string) bool {
+	suite, ok := cg.groups[group]
+	if !ok {
+		return false
+	}
+	suite.Delete(connection)
+	removeMember(cg.connections, connection, group)
+	if suite.isEmpty() {
+		delete(cg.groups, group)
+	}
+	return true
+}
+
+func (cg *connectionGroup) removeConnection(connection string) {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	for group := range cg.connections[connection] {
+		cg.removeLocked(group, connection)
+	}
+}
+
+// addUser reads the connections of the user under the lock, so that a
+// connection added meanwhile joins the group in joinUserGroups.
+func (cg *connectionGroup) addUser(group string, user string, connections func(string) []*connectionCtx) {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	addMember(cg.users, user, group)
+	for _, ctx := range connections(user) {
+		cg.addLocked(group, ctx)
+	}
+}
+
+func (cg *connectionGroup) removeUser(group string, user string, connections func(string) []*connectionCtx) {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	removeMember(cg.users, user, group)
+	for _, ctx := range connections(user) {
+		cg.removeLocked(group, ctx.connectionId)
+	}
+}
+
+// joinUserGroups adds a new connection to the groups of its user.
+func (cg *connectionGroup) joinUserGroups(ctx *connectionCtx) {
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	for group := range cg.users[ctx.userId] {
+		cg.addLocked(group, ctx)
+	}
+}
+
+func (cg *connectionGroup) get(group string) *connectionSuite {
+	cg.lock.RLock()
+	defer cg.lock.RUnlock()
+	return cg.groups[group]
+}
+
+func (cg *connectionGroup) members(group string) []string {
+	cg.lock.RLock()
+	defer cg.lock.RUnlock()
+	connections := []string{}
+	if suite, ok := cg.groups[group]; ok {
+		suite.forEach(func(ctx *connectionCtx) {
+			connections = append(connections, ctx.connectionId)
+		})
+	}
+	sort.Strings(connections)
+	return connections
+}
+
+func (cg *connectionGroup) groupsOfConnection(connection string) []string {
+	cg.lock.RLock()
+	defer cg.lock.RUnlock()
+	return sortedKeys(cg.connections[connection])
+}
+
+func (cg *connectionGroup) groupsOfUser(user string, connections []*connectionCtx) []string {
+	cg.lock.RLock()
+	defer cg.lock.RUnlock()
+	groups := make(map[string]bool)
+	for group := range cg.users[user] {
+		groups[group] = true
+	}
+	for _, ctx := range connections {
+		for group := range cg.connections[ctx.connectionId] {
+			groups[group] = true
+		}
+	}
+	return sortedKeys(groups)
+}
+
+func addMember(index map[string]map[string]bool, key string, group string) {
+	groups, ok := index[key]
+	if !ok {
+		groups = make(map[string]bool)
+		index[key] = groups
+	}
+	groups[group] = true
+}
+
+func removeMember(index map[string]map[string]bool, key string, group string) {
+	groups, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(groups, group)
+	if len(groups) == 0 {
+		delete(index, key)
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
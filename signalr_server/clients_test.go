@@ -0,0 +1,174 @@
+package signalr_server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newTestConnection returns a connection whose messages stay in its outbound
+// queue, as no write pump drains it.
+func newTestConnection(connectionId string, userId string) *connectionCtx {
+	ctx := &connectionCtx{
+		connectionId: connectionId,
+		userId:       userId,
+		conn:         discardConnection{},
+		end:          make(chan any),
+		eCh:          make(chan error, 1),
+		outbound:     newOutboundQueue(Options{}),
+	}
+	var prtl protocol = &jsonProtocol{}
+	ctx.prtl.Store(&prtl)
+	return ctx
+}
+
+func queued(ctx *connectionCtx) int {
+	return ctx.outbound.metrics().Depth
+}
+
+func TestAddUserToGroupJoinsCurrentAndFutureConnections(t *testing.T) {
+	clients := CreateDefaultClients()
+	first := newTestConnection("first", "alice")
+	clients.addConnection(first)
+	clients.addConnection(newTestConnection("other", "bob"))
+
+	if err := clients.AddUserToGroup("alice", "room"); err != nil {
+		t.Fatal(err)
+	}
+	if got := clients.GroupMembers("room"); !reflect.DeepEqual(got, []string{"first"}) {
+		t.Errorf("members: got %v, want [first]", got)
+	}
+
+	second := newTestConnection("second", "alice")
+	clients.addConnection(second)
+	if got := clients.GroupMembers("room"); !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Errorf("members after reconnect: got %v, want [first second]", got)
+	}
+	if got := clients.GroupsOfConnection("second"); !reflect.DeepEqual(got, []string{"room"}) {
+		t.Errorf("groups of second: got %v, want [room]", got)
+	}
+
+	clients.Group("room").Send("Receive", "hi")
+	if queued(first) != 1 || queued(second) != 1 {
+		t.Errorf("group send: got %d and %d queued messages, want 1 each", queued(first), queued(second))
+	}
+}
+
+func TestUserGroupMembershipOutlivesConnections(t *testing.T) {
+	clients := CreateDefaultClients()
+	clients.addConnection(newTestConnection("first", "alice"))
+	if err := clients.AddUserToGroup("alice", "room"); err != nil {
+		t.Fatal(err)
+	}
+	clients.removeConnection("first")
+	if got := clients.GroupsOfUser("alice"); !reflect.DeepEqual(got, []string{"room"}) {
+		t.Errorf("groups of offline user: got %v, want [room]", got)
+	}
+
+	clients.addConnection(newTestConnection("second", "alice"))
+	if got := clients.GroupMembers("room"); !reflect.DeepEqual(got, []string{"second"}) {
+		t.Errorf("members: got %v, want [second]", got)
+	}
+}
+
+func TestRemoveUserFromGroup(t *testing.T) {
+	clients := CreateDefaultClients()
+	clients.addConnection(newTestConnection("first", "alice"))
+	clients.AddUserToGroup("alice", "room")
+	clients.AddConnectionToGroup("first", "lobby")
+
+	if err := clients.RemoveUserFromGroup("alice", "room"); err != nil {
+		t.Fatal(err)
+	}
+	if got := clients.GroupMembers("room"); len(got) != 0 {
+		t.Errorf("members: got %v, want none", got)
+	}
+	if got := clients.GroupsOfUser("alice"); !reflect.DeepEqual(got, []string{"lobby"}) {
+		t.Errorf("groups of user: got %v, want [lobby]", got)
+	}
+
+	clients.addConnection(newTestConnection("second", "alice"))
+	if got := clients.GroupsOfConnection("second"); len(got) != 0 {
+		t.Errorf("new connection joined %v after the user was removed", got)
+	}
+	if err := clients.AddUserToGroup("", "room"); err == nil {
+		t.Error("empty user was added to a group")
+	}
+}
+
+func TestEmptyGroupsAreDeleted(t *testing.T) {
+	clients := CreateDefaultClients()
+	clients.addConnection(newTestConnection("first", ""))
+	clients.addConnection(newTestConnection("second", ""))
+	clients.AddConnectionToGroup("first", "room")
+	clients.AddConnectionToGroup("second", "room")
+	groups := clients.(clientsImp).groupMap
+
+	clients.RemoveConnectionFromGroup("first", "room")
+	if groups.get("room") == nil {
+		t.Fatal("group was deleted while it has a member")
+	}
+	clients.removeConnection("second")
+	if groups.get("room") != nil {
+		t.Error("empty group was not deleted")
+	}
+	if len(groups.connections) != 0 {
+		t.Errorf("memberships of removed connections leaked: %v", groups.connections)
+	}
+	if err := clients.RemoveConnectionFromGroup("first", "room"); err == nil {
+		t.Error("removal from a deleted group succeeded")
+	}
+}
+
+func TestGroupTargetsFollowRecreatedGroups(t *testing.T) {
+	clients := CreateDefaultClients()
+	first := newTestConnection("first", "")
+	second := newTestConnection("second", "")
+	clients.addConnection(first)
+	clients.addConnection(second)
+	room := clients.Group("room")
+	rooms := clients.Groups("room", "lobby")
+
+	clients.AddConnectionToGroup("first", "room")
+	clients.RemoveConnectionFromGroup("first", "room")
+	clients.AddConnectionToGroup("second", "room")
+
+	room.Send("Receive", "hi")
+	rooms.Send("Receive", "hi")
+	if queued(first) != 0 || queued(second) != 2 {
+		t.Errorf("got %d and %d queued messages, want 0 and 2", queued(first), queued(second))
+	}
+}
+
+func TestUserTargetsFollowNewConnections(t *testing.T) {
+	clients := CreateDefaultClients()
+	alice := clients.User("alice")
+	connection := newTestConnection("first", "alice")
+	clients.addConnection(connection)
+
+	alice.Send("Receive", "hi")
+	if queued(connection) != 1 {
+		t.Errorf("got %d queued messages, want 1", queued(connection))
+	}
+}
+
+func TestSendSkipsConnectionsInHandshake(t *testing.T) {
+	ctx := newTestConnection("first", "")
+	ctx.prtl.Store(nil)
+	ctx.Send("Receive", "hi")
+	if queued(ctx) != 0 {
+		t.Errorf("got %d queued messages, want none", queued(ctx))
+	}
+}
+
+func TestSendLogsMarshalErrors(t *testing.T) {
+	ctx := newTestConnection("first", "")
+	ctx.Send("Receive", func() {})
+	if queued(ctx) != 0 {
+		t.Errorf("got %d queued messages, want none", queued(ctx))
+	}
+	select {
+	case err := <-ctx.eCh:
+		t.Errorf("connection ended with %v", err)
+	default:
+	}
+}
@@ -1,27 +1,54 @@
 package signalr_server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"reflect"
+	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 type connectionCtx struct {
 	conn         connection
 	hub          hubInterface
 	connectionId string
-	lastMsg      atomic.Value
-	eCh          chan error
-	msgCh        chan []byte
-	end          chan any
-	prtl         protocol
+	// connectionToken is the secret the transports address the connection with
+	connectionToken string
+	// principal is the authenticated caller, nil without an Authenticator
+	principal *Principal
+	userId    string
+	filters   []HubFilter
+	// callerContext is shared with the hub of the connection
+	callerContext *HubCallerContext
+	lastMsg       atomic.Value
+	eCh           chan error
+	msgCh         chan []byte
+	end           chan any
+	// prtl is set by the handshake and read from any goroutine sending
+	prtl        atomic.Pointer[protocol]
+	invocations *invocationTracker
+	descriptor  *hubDescriptor
+	connected   atomic.Bool
+	// pending holds the client results awaited by Invoke, by invocation id
+	pending       sync.Map
+	invocationSeq atomic.Int64
+	// streams holds the streams uploaded by the client, by stream id. Their
+	// channels are only touched from the inbound goroutine.
+	streams     map[string]*clientStream
+	streamsLock sync.Mutex
+	// connectionContext lives as long as the connection, it is the parent of
+	// every invocation context and is canceled when the connection ends
+	connectionContext context.Context
+	cancelConnection  context.CancelFunc
+	// cancels holds the cancel functions of stream invocations, by invocation id
+	cancels sync.Map
+	// outbound holds the messages to the client, written by writePump once the
+	// handshake is done
+	outbound *outboundQueue
 }
 
-func initConnectionCtx(connectionId string, conn connection, hub hubInterface) *connectionCtx {
+func initConnectionCtx(parent context.Context, connectionId string, conn connection, hub hubInterface, hc handlerContext) *connectionCtx {
 	// the called Id will be used inside the hub
 	hub.setCallerId(connectionId)
 	ctx := &connectionCtx{
@@ -32,7 +59,15 @@ func initConnectionCtx(connectionId string, conn connection, hub hubInterface) *
 		eCh:          make(chan error),
 		msgCh:        make(chan []byte),
 		end:          make(chan any),
+		streams:      make(map[string]*clientStream),
+		invocations:  &hc.server.invocations,
+		descriptor:   hc.hubDescriptor,
+		filters:      append(append([]HubFilter{}, hc.server.HubFilters...), hub.GetOptions().HubFilters...),
+		outbound:     newOutboundQueue(hub.GetOptions()),
 	}
+	// the request creating the connection may well complete before the
+	// connection does, as for long polling, so only its values are kept
+	ctx.connectionContext, ctx.cancelConnection = context.WithCancel(context.WithoutCancel(parent))
 	ctx.lastMsg.Store(time.Now())
 	return ctx
 }
@@ -42,25 +77,28 @@ func (ctx *connectionCtx) handshake() error {
 	if err != nil {
 		return err
 	}
-	protocol := &jsonProtocol{}
+	handshakeProtocol := &jsonProtocol{}
 	// todo: handle incomplete msg
-	protocol.verifyAndRemoveMessageSeparator(p)
+	p, err = handshakeProtocol.verifyAndRemoveMessageSeparator(p)
+	if err != nil {
+		return err
+	}
 	handshakeRequest := &HandshakeRequest{}
-	err = json.Unmarshal(p[:len(p)-1], handshakeRequest)
+	err = json.Unmarshal(p, handshakeRequest)
 	if err != nil {
 		return err
 	}
+	var hubProtocol protocol
 	switch handshakeRequest.Protocol {
 	case "json":
-		ctx.prtl = &jsonProtocol{}
+		hubProtocol = &jsonProtocol{}
 	case "messagepack":
-		ctx.prtl = &msgpackProtocol{}
+		hubProtocol = &msgpackProtocol{
+			arrayEncodedStructs: ctx.hub.GetOptions().MessagePackStructsAsArrays,
+		}
 	default:
 		return errors.New("unknown protocol:" + handshakeRequest.Protocol)
 	}
-	if ctx.connectionId == "" {
-		ctx.connectionId = uuid.NewString()
-	}
 
 	handshakeResponse := &HandshakeResponse{}
 	handshakeResponseBytes, err := json.Marshal(handshakeResponse)
@@ -68,133 +106,111 @@ func (ctx *connectionCtx) handshake() error {
 	if err != nil {
 		return err
 	}
-	ctx.writeMsg(handshakeResponseBytes)
+	// the handshake response is always json, whatever the hub protocol is
+	handshakeResponseBytes, err = handshakeProtocol.appendMessageSeparator(handshakeResponseBytes)
+	if err != nil {
+		return err
+	}
+	if err = ctx.conn.send(handshakeResponseBytes); err != nil {
+		return err
+	}
+	if wsc, ok := ctx.conn.(*webSocketConnection); ok {
+		wsc.setBinary(handshakeRequest.Protocol == "messagepack")
+	}
+	if ctx.callerContext != nil {
+		ctx.callerContext.Protocol = handshakeRequest.Protocol
+	}
+	ctx.prtl.Store(&hubProtocol)
 	return nil
 }
 
 func (ctx *connectionCtx) handleInbound(hub hubInterface) {
+	// the hub methods still reading uploaded streams must not wait forever
+	defer ctx.closeAllClientStreams()
 	err := ctx.handshake()
 	if err != nil {
 		ctx.writeError(err)
 		return
 	}
+	go ctx.writePump()
+	ctx.connected.Store(true)
+	err = ctx.callLifecycle("OnConnected", func() error {
+		return ctx.onConnectedPipeline(ctx.connectionContext, func(c context.Context, lifetime *HubLifetimeContext) error {
+			if ctx.descriptor.onConnected {
+				hub.(connectedHub).OnConnected(c)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		ctx.writeError(err)
+		return
+	}
 	for {
 		p, err := ctx.conn.read()
 		if err != nil {
+			if closedByClient(err) {
+				// a graceful close is not an error for OnDisconnected
+				err = nil
+			}
 			ctx.writeError(err)
 			return
 		}
 
-		p = ctx.prtl.verifyAndRemoveMessageSeparator(p)
-		msg, err := ctx.prtl.unmarshal(p)
+		messages, err := ctx.protocol().splitMessages(p)
 		if err != nil {
 			ctx.writeError(err)
 			return
 		}
-		switch m := msg.(type) {
-		case PingMsg:
-			LogDebug("ping")
-			ctx.lastMsg.Store(time.Now())
-		case CloseMsg:
-			ctx.closeGracefully()
-		case Invocation:
-			ctx.lastMsg.Store(time.Now())
-			LogDebug(m)
-			target := m.Target
-			// So we don't modify the template hub
-
-			method := reflect.ValueOf(hub).MethodByName(target)
-
-			if !method.IsValid() {
-				ctx.writeError(errors.New("method doesn't exist"))
-				return
-			}
-			values := make([]reflect.Value, len(m.Arguments))
-			numIn := method.Type().NumIn()
-			if numIn != len(m.Arguments) {
-				ctx.writeError(errors.New("wrong number of arguments"))
+		// a frame may well hold several messages
+		for _, p := range messages {
+			if !ctx.handleMessage(hub, p) {
 				return
 			}
-			for i, argument := range m.Arguments {
-				bytes := argument.([]byte)
-				v, err := ctx.prtl.unmarshalArgument(bytes, method.Type().In(i))
-				if err != nil {
-					ctx.writeError(err)
-					return
-				}
-				values[i] = v
-			}
-			// the method might take very long time. Use another goroutine
-			go func() {
-				response := method.Call(values)
-
-				LogDebug(response)
-				resultsArray := make([]any, len(response))
-				for i, r := range response {
-					resultsArray[i] = r.Interface()
-				}
-				var result any
-				switch len(resultsArray) {
-				case 0:
-					result = nil
-				case 1:
-					result = resultsArray[0]
-				default:
-					result = resultsArray
-				}
-				if m.InvocationId != "" {
-					completeMsg := Completion{
-						Type:         CompletionType,
-						InvocationId: m.InvocationId,
-					}
-					if m.Type == StreamInvocationType {
-						if len(resultsArray) != 1 {
-							ctx.writeError(errors.New("stream method should return one result"))
-							return
-						}
-
-						v := reflect.ValueOf(result)
-						if v.Kind() != reflect.Chan {
-							ctx.writeError(errors.New("this is not a stream method"))
-							return
-						}
-						for {
-							receivedValue, ok := v.Recv()
-							if !ok {
-								break
-							}
-							invocationResult := StreamItem{
-								Type:         StreamItemType,
-								InvocationId: m.InvocationId,
-								Item:         receivedValue.Interface(),
-							}
-							invocationResultBytes, err := ctx.prtl.marshal(invocationResult)
-							if err != nil {
-								completeMsg.Error = err.Error()
-								break
-							}
-							ctx.writeMsg(invocationResultBytes)
-						}
-					} else {
-						completeMsg.Result = result
-					}
-					invocationResultBytes, err := ctx.prtl.marshal(completeMsg)
-					if err != nil {
-						ctx.writeError(err)
-						return
-					}
-					ctx.writeMsg(invocationResultBytes)
-				} else {
-					LogDebug("invocationId is empty")
-				}
-			}()
-		default:
-			ctx.writeError(errors.New("unknown message type"))
-			return
 		}
 	}
 }
 
+// handleMessage dispatches a message of the client and reports whether the
+// connection goes on.
+func (ctx *connectionCtx) handleMessage(hub hubInterface, p []byte) bool {
+	msg, err := ctx.protocol().unmarshal(p)
+	if err != nil {
+		ctx.writeError(err)
+		return false
+	}
+	switch m := msg.(type) {
+	case PingMsg:
+		LogDebug("ping")
+		ctx.lastMsg.Store(time.Now())
+	case CloseMsg:
+		// a nil error marks the close as initiated by the client
+		ctx.writeError(nil)
+		return false
+	case Invocation:
+		ctx.lastMsg.Store(time.Now())
+		LogDebug(m)
+		ctx.handleInvocation(hub, m)
+	case CancelInvocationMsg:
+		ctx.lastMsg.Store(time.Now())
+		ctx.handleCancelInvocation(m)
+	case StreamItem:
+		ctx.lastMsg.Store(time.Now())
+		ctx.handleStreamItem(m)
+	case Completion:
+		ctx.lastMsg.Store(time.Now())
+		if _, ok := ctx.clientStream(m.InvocationId); ok {
+			ctx.completeClientStream(m)
+		} else {
+			ctx.handleCompletion(m)
+		}
+	default:
+		ctx.writeError(errors.New("unknown message type"))
+		return false
+	}
+	return true
+}
+
 func (ctx *connectionCtx) start() {
 	ctx.hub.Clients().addConnection(ctx)
 
@@ -211,7 +227,7 @@ func (ctx *connectionCtx) checkPingLoop(timeout int) {
 		time.Sleep(5 * time.Second)
 		lastMsg := ctx.lastMsg.Load().(time.Time)
 		if time.Now().Sub(lastMsg) > time.Duration(timeout)*time.Second {
-			ctx.writeError(errors.New("ping timeout"))
+			ctx.writeError(errPingTimeout)
 			return
 		}
 	}
@@ -226,8 +242,8 @@ func (ctx *connectionCtx) writePingLoop(interval int) {
 		case <-ctx.end:
 			return
 		case <-ticker.C:
-			if ctx.prtl != nil {
-				ctx.writeMsg(ctx.prtl.pingMsg())
+			if prtl := ctx.protocol(); prtl != nil {
+				ctx.writeMsg(prtl.pingMsg())
 			}
 		}
 	}
@@ -235,31 +251,175 @@ func (ctx *connectionCtx) writePingLoop(interval int) {
 
 func (ctx *connectionCtx) waitError() {
 	err := <-ctx.eCh
-	LogWarning("", err)
+	if err != nil {
+		LogWarning("", err)
+	} else {
+		LogDebug("connection closed by client")
+	}
+	// the client closed the connection itself, no need to tell it
+	if err != nil {
+		ctx.sendClose(err)
+	}
+	ctx.outbound.close()
 	close(ctx.end)
+	ctx.cancelConnection()
 	ctx.closeGracefully()
+	if ctx.connected.Load() {
+		lifecycleErr := ctx.callLifecycle("OnDisconnected", func() error {
+			// the connection context is canceled by now, yet cleanup must run
+			return ctx.onDisconnectedPipeline(context.WithoutCancel(ctx.connectionContext), err, func(c context.Context, lifetime *HubLifetimeContext, err error) error {
+				if ctx.descriptor.onDisconnected {
+					ctx.hub.(disconnectedHub).OnDisconnected(c, err)
+				}
+				return nil
+			})
+		})
+		if lifecycleErr != nil {
+			LogWarning("OnDisconnected failed", lifecycleErr)
+		}
+	}
+}
+
+// callLifecycle runs a hub lifecycle callback and its filters, recovering any
+// panic in them.
+func (ctx *connectionCtx) callLifecycle(name string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoveredError(name, r)
+		}
+	}()
+	return f()
 }
 
+// Send queues an invocation to the connection. Like a broadcast, it skips a
+// connection still in its handshake and only logs an invocation that can't
+// be marshalled, which is no fault of the client.
 func (ctx *connectionCtx) Send(method string, args ...any) {
 	LogDebug("invoke client")
-	invocation := Invocation{
-		Type:      InvocationType,
-		Target:    method,
-		Arguments: args,
+	prtl := ctx.protocol()
+	if prtl == nil {
+		return
 	}
-	invocationBytes, err := ctx.prtl.marshal(invocation)
+	frame, err := newInvocationFrames(method, args).frame(prtl)
 	if err != nil {
-		ctx.writeError(err)
+		LogError("failed to marshal invocation of "+method, err)
 		return
 	}
-	ctx.writeMsg(invocationBytes)
+	ctx.writeFrame(frame)
+}
+
+// closeError ends a connection with a Close message telling the client why
+// and whether it may reconnect.
+type closeError struct {
+	reason         string
+	allowReconnect bool
+}
+
+func (e *closeError) Error() string {
+	return e.reason
+}
+
+// closeMessageTimeout bounds how long a closing connection waits for the
+// Close message to be written, e.g. picked up by the next long polling request.
+const closeMessageTimeout = 5 * time.Second
+
+var errPingTimeout = &closeError{reason: "ping timeout", allowReconnect: true}
+
+// sendClose notifies the client that the server is closing the connection
+// because of err. The Close message is queued after the pending messages,
+// whatever room is left, as nobody reads eCh anymore.
+func (ctx *connectionCtx) sendClose(err error) {
+	prtl := ctx.protocol()
+	if prtl == nil {
+		return
+	}
+	closeMsg := CloseMsg{Type: CloseType}
+	var ce *closeError
+	if errors.As(err, &ce) {
+		closeMsg.Error = ce.reason
+		closeMsg.AllowReconnect = ce.allowReconnect
+	} else {
+		closeMsg.Error = "Connection closed with an error."
+		if ctx.hub.GetOptions().DetailedErrors {
+			closeMsg.Error += " " + err.Error()
+		}
+	}
+	closeBytes, err := prtl.marshal(closeMsg)
+	if err == nil {
+		closeBytes, err = prtl.appendMessageSeparator(closeBytes)
+	}
+	if err != nil {
+		LogError("failed to marshal close message", err)
+		return
+	}
+	if !ctx.outbound.closeWith(closeBytes) {
+		return
+	}
+	select {
+	case <-ctx.outbound.drained:
+	case <-time.After(closeMessageTimeout):
+	}
+}
+
+// abort closes the connection with a Close message carrying reason.
+func (ctx *connectionCtx) abort(reason string, allowReconnect bool) {
+	ctx.writeError(&closeError{reason: reason, allowReconnect: allowReconnect})
+}
+
+// protocol returns the hub protocol negotiated by the handshake, nil before.
+func (ctx *connectionCtx) protocol() protocol {
+	if prtl := ctx.prtl.Load(); prtl != nil {
+		return *prtl
+	}
+	return nil
 }
 
 func (ctx *connectionCtx) writeMsg(msg []byte) {
-	err := ctx.conn.send(ctx.prtl.appendMessageSeparator(msg))
+	msg, err := ctx.protocol().appendMessageSeparator(msg)
+	if err != nil {
+		ctx.writeError(err)
+		return
+	}
+	ctx.writeFrame(msg)
+}
+
+// writeFrame queues a message already framed by the connection's protocol.
+func (ctx *connectionCtx) writeFrame(frame []byte) {
+	err := ctx.sendFrame(context.Background(), frame)
+	if err != nil && err != errConnectionEnded {
+		LogWarning("failed to send to connection "+ctx.connectionId, err)
+	}
+}
+
+// sendFrame is writeFrame reporting why the message was not queued. A slow
+// consumer is disconnected under QueueDisconnect.
+func (ctx *connectionCtx) sendFrame(c context.Context, frame []byte) error {
+	return ctx.queued(ctx.outbound.push(c, frame))
+}
+
+// writeResult queues a stream item or completion of one of the caller's
+// invocations. It waits for room in the queue whatever its policy, until the
+// connection ends or c is done, and reports whether the message was queued.
+func (ctx *connectionCtx) writeResult(c context.Context, msg []byte) bool {
+	frame, err := ctx.protocol().appendMessageSeparator(msg)
 	if err != nil {
 		ctx.writeError(err)
+		return false
 	}
+	return ctx.outbound.pushResult(c, frame) == nil
+}
+
+// tryFrame is sendFrame never waiting for room in the queue.
+func (ctx *connectionCtx) tryFrame(frame []byte) error {
+	return ctx.queued(ctx.outbound.tryPush(frame))
+}
+
+// queued disconnects a slow consumer once its queue refused a frame.
+func (ctx *connectionCtx) queued(err error) error {
+	if err == errSlowConsumer {
+		go ctx.writeError(err)
+	}
+	return err
 }
 
 func (ctx *connectionCtx) writeError(err error) {
@@ -271,4 +431,7 @@ func (ctx *connectionCtx) writeError(err error) {
 
 func (ctx *connectionCtx) closeGracefully() {
 	ctx.hub.Clients().removeConnection(ctx.connectionId)
+	if ctx.connectionToken != "" {
+		ctx.descriptor.connectionTokens.Delete(ctx.connectionToken)
+	}
 }
@@ -0,0 +1,107 @@
+package signalr_server
+
+import (
+	"context"
+)
+
+// HubInvocationContext describes a hub method invocation to the filters.
+// Target is the Go name of the hub method and Headers those the client sent
+// with the invocation. Filters may replace the arguments before calling next.
+type HubInvocationContext struct {
+	Hub          any
+	Target       string
+	Arguments    []any
+	Headers      map[string]string
+	ConnectionId string
+	UserId       string
+	Principal    *Principal
+	Caller       *HubCallerContext
+}
+
+// HubLifetimeContext describes a connection to the filters when it connects or
+// disconnects.
+type HubLifetimeContext struct {
+	Hub          any
+	ConnectionId string
+	UserId       string
+	Principal    *Principal
+	Caller       *HubCallerContext
+}
+
+type InvokeMethodFunc func(ctx context.Context, invocation *HubInvocationContext) (any, error)
+
+type OnConnectedFunc func(ctx context.Context, lifetime *HubLifetimeContext) error
+
+type OnDisconnectedFunc func(ctx context.Context, lifetime *HubLifetimeContext, err error) error
+
+// HubFilter wraps hub method invocations and lifecycle callbacks, e.g. for
+// logging, metrics or validation. A filter short-circuits by returning an
+// error instead of calling next. Embed HubFilterBase to only implement some of
+// the hooks.
+type HubFilter interface {
+	InvokeMethod(ctx context.Context, invocation *HubInvocationContext, next InvokeMethodFunc) (any, error)
+	OnConnected(ctx context.Context, lifetime *HubLifetimeContext, next OnConnectedFunc) error
+	OnDisconnected(ctx context.Context, lifetime *HubLifetimeContext, err error, next OnDisconnectedFunc) error
+}
+
+// HubFilterBase passes every hook to the next filter.
+type HubFilterBase struct {
+}
+
+func (HubFilterBase) InvokeMethod(ctx context.Context, invocation *HubInvocationContext, next InvokeMethodFunc) (any, error) {
+	return next(ctx, invocation)
+}
+
+func (HubFilterBase) OnConnected(ctx context.Context, lifetime *HubLifetimeContext, next OnConnectedFunc) error {
+	return next(ctx, lifetime)
+}
+
+func (HubFilterBase) OnDisconnected(ctx context.Context, lifetime *HubLifetimeContext, err error, next OnDisconnectedFunc) error {
+	return next(ctx, lifetime, err)
+}
+
+// The filters of the server come first, then the filters of the hub, and the
+// first filter is the outermost one.
+
+func (ctx *connectionCtx) invokeMethodPipeline(c context.Context, invocation *HubInvocationContext, core InvokeMethodFunc) (any, error) {
+	next := core
+	for i := len(ctx.filters) - 1; i >= 0; i-- {
+		filter, inner := ctx.filters[i], next
+		next = func(c context.Context, invocation *HubInvocationContext) (any, error) {
+			return filter.InvokeMethod(c, invocation, inner)
+		}
+	}
+	return next(c, invocation)
+}
+
+func (ctx *connectionCtx) onConnectedPipeline(c context.Context, core OnConnectedFunc) error {
+	next := core
+	for i := len(ctx.filters) - 1; i >= 0; i-- {
+		filter, inner := ctx.filters[i], next
+		next = func(c context.Context, lifetime *HubLifetimeContext) error {
+			return filter.OnConnected(c, lifetime, inner)
+		}
+	}
+	return next(c, ctx.lifetimeContext())
+}
+
+func (ctx *connectionCtx) onDisconnectedPipeline(c context.Context, err error, core OnDisconnectedFunc) error {
+	next := core
+	for i := len(ctx.filters) - 1; i >= 0; i-- {
+		filter, inner := ctx.filters[i], next
+		next = func(c context.Context, lifetime *HubLifetimeContext, err error) error {
+			return filter.OnDisconnected(c, lifetime, err, inner)
+		}
+	}
+	return next(c, ctx.lifetimeContext(), err)
+}
+
+func (ctx *connectionCtx) lifetimeContext() *HubLifetimeContext {
+	return &HubLifetimeContext{
+		Hub:          ctx.hub,
+		ConnectionId: ctx.connectionId,
+		UserId:       ctx.userId,
+		Principal:    ctx.principal,
+		Caller:       ctx.callerContext,
+	}
+}
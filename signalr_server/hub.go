@@ -2,26 +2,132 @@ package signalr_server
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
 	"reflect"
+	"sync"
 )
 
+// HubCallerContext describes the connection of the caller. It is shared by all
+// the invocations of a connection, so per connection state goes into Items
+// rather than into hub fields.
+type HubCallerContext struct {
+	ConnectionId string
+	UserId       string
+	Principal    *Principal
+	// Headers and Query are those of the request that created the connection,
+	// the headers without Authorization and the query without the id and
+	// access_token parameters.
+	Headers    http.Header
+	Query      url.Values
+	RemoteAddr string
+	// Transport is one of WebSockets, ServerSentEvents and LongPolling.
+	Transport string
+	// Protocol is the hub protocol, known once the handshake completed.
+	Protocol string
+	// Items is a concurrency-safe bag for per connection data.
+	Items sync.Map
+	// ConnectionAborted is canceled when the connection closes.
+	ConnectionAborted context.Context
+}
+
 type hubInterface interface {
-	Clients() Clients
+	Clients() HubCallerClients
 	GetOptions() Options
 	init(clients Clients)
 	setCallerId(callerId string)
 	setContext(c context.Context)
+	setPrincipal(principal *Principal)
+	setUserId(userId string)
+	setCallerContext(callerContext *HubCallerContext)
+}
+
+// connectedHub is implemented by hubs that want to be notified once a client
+// has completed the handshake.
+type connectedHub interface {
+	OnConnected(ctx context.Context)
+}
+
+// disconnectedHub is implemented by hubs that want to be notified once a
+// connection is torn down. err is nil when the client closed gracefully.
+type disconnectedHub interface {
+	OnDisconnected(ctx context.Context, err error)
+}
+
+// authorizingHub is implemented by hubs restricting which methods a caller
+// can invoke. method is the Go name of the hub method, whatever the name the
+// client used. A non nil error rejects the invocation.
+type authorizingHub interface {
+	Authorize(method string, principal *Principal) error
+}
+
+// hubDescriptor holds what is learned about a hub when it is registered.
+type hubDescriptor struct {
+	hub     hubInterface
+	name    string
+	methods map[string]*hubMethod
+	// hiddenMethods are the lower case names of the exported methods clients
+	// can't invoke
+	hiddenMethods  map[string]bool
+	onConnected    bool
+	onDisconnected bool
+	authorize      bool
+	// connectionTokens maps the connection tokens handed out by negotiate to
+	// the public connection ids
+	connectionTokens *sync.Map
+	// clients is set once the hub is bound
+	clients Clients
+}
+
+func newHubDescriptor(hub hubInterface) (*hubDescriptor, error) {
+	hubVal := reflect.ValueOf(hub)
+	if hubVal.Kind() != reflect.Ptr || hubVal.IsNil() || hubVal.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("hub %T is invalid: expected a non nil pointer to a struct", hub)
+	}
+	name := hubVal.Elem().Type().Name()
+	methods, hiddenMethods, err := buildHubMethods(hub, hub.GetOptions())
+	if err != nil {
+		return nil, fmt.Errorf("hub %s is invalid: %w", name, err)
+	}
+	_, onConnected := hub.(connectedHub)
+	_, onDisconnected := hub.(disconnectedHub)
+	_, authorize := hub.(authorizingHub)
+	return &hubDescriptor{
+		hub:              hub,
+		name:             name,
+		methods:          methods,
+		hiddenMethods:    hiddenMethods,
+		onConnected:      onConnected,
+		onDisconnected:   onDisconnected,
+		authorize:        authorize,
+		connectionTokens: &sync.Map{},
+	}, nil
 }
 
 type Hub struct {
 	clients Clients
 	Options Options
 	Caller  string
+	// Context lives as long as the connection of the caller and is canceled
+	// when it closes.
 	Context context.Context
+	// Principal is the authenticated caller, nil without an Authenticator
+	Principal     *Principal
+	userId        string
+	callerContext *HubCallerContext
+}
+
+func (hub *Hub) Clients() HubCallerClients {
+	return callerClients{hubClients: hub.clients, caller: hub.Caller}
 }
 
-func (hub *Hub) Clients() Clients {
-	return hub.clients
+// Abort closes the connection of the caller. The client is told the reason
+// and that it should not reconnect.
+func (hub *Hub) Abort(reason string) {
+	if err := hub.clients.CloseConnection(hub.Caller, reason, false); err != nil {
+		LogWarning("failed to abort connection "+hub.Caller, err)
+	}
 }
 
 func (hub *Hub) setCallerId(caller string) {
@@ -32,6 +138,28 @@ func (hub *Hub) setContext(c context.Context) {
 	hub.Context = c
 }
 
+func (hub *Hub) setPrincipal(principal *Principal) {
+	hub.Principal = principal
+}
+
+// UserId returns the user id of the caller, empty for anonymous callers.
+func (hub *Hub) UserId() string {
+	return hub.userId
+}
+
+func (hub *Hub) setUserId(userId string) {
+	hub.userId = userId
+}
+
+// CallerContext returns the context of the caller's connection.
+func (hub *Hub) CallerContext() *HubCallerContext {
+	return hub.callerContext
+}
+
+func (hub *Hub) setCallerContext(callerContext *HubCallerContext) {
+	hub.callerContext = callerContext
+}
+
 func (hub *Hub) GetOptions() Options {
 	return hub.Options
 }
@@ -0,0 +1,203 @@
+package signalr_server
+
+import (
+	"errors"
+	"fmt"
+	"go/token"
+	"reflect"
+	"strings"
+)
+
+// hubMethod is what is learned about a hub method when the hub is registered,
+// so invocations don't need to inspect its signature again.
+type hubMethod struct {
+	name  string
+	index int
+	// paramTypes doesn't hold the context parameter, if any
+	paramTypes   []reflect.Type
+	hasContext   bool
+	numStreams   int
+	hasResult    bool
+	returnsError bool
+	// isStream is set for methods returning a channel
+	isStream bool
+}
+
+// lifecycleMethods are the hub callbacks, which clients can't invoke.
+var lifecycleMethods = map[string]bool{
+	"OnConnected":    true,
+	"OnDisconnected": true,
+	"Authorize":      true,
+}
+
+// buildHubMethods builds the method table of a hub and rejects the methods
+// whose signature can't be invoked by clients. The table is keyed by lower
+// case name as clients resolve hub methods case-insensitively, like .NET.
+//
+// Only the methods declared on the hub type itself are exposed. The methods
+// promoted from embedded fields, like Hub.Clients, are hidden unless they are
+// listed in Options.IncludedMethods. The names of the methods clients can't
+// invoke are returned, so they get a clear error.
+func buildHubMethods(hub hubInterface, options Options) (map[string]*hubMethod, map[string]bool, error) {
+	excluded := make(map[string]bool)
+	for _, name := range options.ExcludedMethods {
+		excluded[name] = true
+	}
+	included := make(map[string]bool)
+	for _, name := range options.IncludedMethods {
+		included[name] = true
+	}
+	hubVal := reflect.ValueOf(hub)
+	hubType := hubVal.Type()
+	promoted := promotedMethodNames(hubType.Elem())
+	methods := make(map[string]*hubMethod)
+	hidden := make(map[string]bool)
+	byName := make(map[string]*hubMethod)
+	for i := 0; i < hubType.NumMethod(); i++ {
+		name := hubType.Method(i).Name
+		if lifecycleMethods[name] || excluded[name] {
+			delete(excluded, name)
+			hidden[strings.ToLower(name)] = true
+			continue
+		}
+		if promoted[name] {
+			if !included[name] {
+				hidden[strings.ToLower(name)] = true
+				continue
+			}
+			delete(included, name)
+		}
+		method, err := newHubMethod(name, i, hubVal.Method(i).Type())
+		if err != nil {
+			return nil, nil, fmt.Errorf("method %s: %w", name, err)
+		}
+		if err := addHubMethod(methods, name, method); err != nil {
+			return nil, nil, err
+		}
+		byName[name] = method
+	}
+	for name := range excluded {
+		return nil, nil, fmt.Errorf("excluded method %s doesn't exist", name)
+	}
+	for name := range included {
+		return nil, nil, fmt.Errorf("included method %s is not promoted from an embedded field", name)
+	}
+	for alias, name := range options.MethodAliases {
+		method, ok := byName[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("alias %s refers to unknown method %s", alias, name)
+		}
+		if err := addHubMethod(methods, alias, method); err != nil {
+			return nil, nil, err
+		}
+	}
+	return methods, hidden, nil
+}
+
+// promotedMethodNames returns the names of the methods a struct gets from its
+// embedded fields. A method the struct redeclares can't be told apart from a
+// promoted one and has to be opted in too.
+func promotedMethodNames(structType reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.Anonymous {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() != reflect.Ptr && fieldType.Kind() != reflect.Interface {
+			fieldType = reflect.PointerTo(fieldType)
+		}
+		for j := 0; j < fieldType.NumMethod(); j++ {
+			names[fieldType.Method(j).Name] = true
+		}
+	}
+	return names
+}
+
+func addHubMethod(methods map[string]*hubMethod, name string, method *hubMethod) error {
+	key := strings.ToLower(name)
+	if other, ok := methods[key]; ok {
+		return fmt.Errorf("method name %s is ambiguous, it also resolves to method %s", name, other.name)
+	}
+	methods[key] = method
+	return nil
+}
+
+func newHubMethod(name string, index int, methodType reflect.Type) (*hubMethod, error) {
+	method := &hubMethod{name: name, index: index}
+	for i := 0; i < methodType.NumIn(); i++ {
+		paramType := methodType.In(i)
+		switch {
+		case paramType == contextType:
+			if i != 0 {
+				return nil, errors.New("context.Context must be the first parameter")
+			}
+			method.hasContext = true
+			continue
+		case isStreamParam(paramType):
+			if err := checkSerializable(paramType.Elem(), true); err != nil {
+				return nil, fmt.Errorf("parameter %d: %w", i, err)
+			}
+			method.numStreams++
+		default:
+			if err := checkSerializable(paramType, true); err != nil {
+				return nil, fmt.Errorf("parameter %d: %w", i, err)
+			}
+		}
+		method.paramTypes = append(method.paramTypes, paramType)
+	}
+	if methodType.IsVariadic() {
+		return nil, errors.New("variadic methods are not supported")
+	}
+
+	numOut := methodType.NumOut()
+	if numOut > 0 && methodType.Out(numOut-1) == errorType {
+		method.returnsError = true
+		numOut--
+	}
+	switch numOut {
+	case 0:
+	case 1:
+		resultType := methodType.Out(0)
+		method.hasResult = true
+		if resultType.Kind() == reflect.Chan {
+			if resultType.ChanDir() == reflect.SendDir {
+				return nil, errors.New("stream methods must return a channel that can be received from")
+			}
+			method.isStream = true
+			resultType = resultType.Elem()
+		}
+		if err := checkSerializable(resultType, false); err != nil {
+			return nil, fmt.Errorf("result: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("methods return at most one value and an error, not %d values", methodType.NumOut())
+	}
+	return method, nil
+}
+
+// checkSerializable rejects the types the hub protocols can't carry. Only
+// empty interfaces can be decoded, so other interfaces are only allowed in
+// results.
+func checkSerializable(t reflect.Type, decode bool) error {
+	switch t.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return fmt.Errorf("type %s can't be serialized", t)
+	case reflect.Interface:
+		if decode && t.NumMethod() > 0 {
+			return fmt.Errorf("interface type %s can't be deserialized", t)
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkSerializable(t.Elem(), decode)
+	case reflect.Map:
+		if err := checkSerializable(t.Key(), decode); err != nil {
+			return err
+		}
+		return checkSerializable(t.Elem(), decode)
+	}
+	if t.PkgPath() != "" && !token.IsExported(t.Name()) {
+		return fmt.Errorf("type %s is not exported", t)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package signalr_server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type tableHub struct {
+	Hub
+}
+
+func (h tableHub) Echo(msg string) string {
+	return msg
+}
+
+func (h tableHub) Add(ctx context.Context, a int, b int) (int, error) {
+	return a + b, nil
+}
+
+func (h tableHub) Count(ctx context.Context, n int) <-chan int {
+	return nil
+}
+
+func (h tableHub) Upload(items <-chan int) {
+}
+
+func (h tableHub) OnConnected(ctx context.Context) {
+}
+
+type point struct {
+	X int
+}
+
+type ctxNotFirstHub struct{ Hub }
+
+func (h ctxNotFirstHub) Method(a int, ctx context.Context) {}
+
+type variadicHub struct{ Hub }
+
+func (h variadicHub) Method(a ...int) {}
+
+type unexportedParamHub struct{ Hub }
+
+func (h unexportedParamHub) Method(p point) {}
+
+type funcParamHub struct{ Hub }
+
+func (h funcParamHub) Method(f func()) {}
+
+type interfaceParamHub struct{ Hub }
+
+func (h interfaceParamHub) Method(s fmt.Stringer) {}
+
+type sendOnlyStreamHub struct{ Hub }
+
+func (h sendOnlyStreamHub) Method() chan<- int { return nil }
+
+type tooManyResultsHub struct{ Hub }
+
+func (h tooManyResultsHub) Method() (int, int, error) { return 0, 0, nil }
+
+func TestBuildHubMethods(t *testing.T) {
+	descriptor, err := newHubDescriptor(&tableHub{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := descriptor.methods["echo"]
+	if echo == nil || echo.name != "Echo" || len(echo.paramTypes) != 1 || !echo.hasResult || echo.returnsError || echo.isStream {
+		t.Errorf("Echo: got %+v", echo)
+	}
+	add := descriptor.methods["add"]
+	if add == nil || !add.hasContext || len(add.paramTypes) != 2 || !add.hasResult || !add.returnsError {
+		t.Errorf("Add: got %+v", add)
+	}
+	count := descriptor.methods["count"]
+	if count == nil || !count.isStream || !count.hasContext {
+		t.Errorf("Count: got %+v", count)
+	}
+	upload := descriptor.methods["upload"]
+	if upload == nil || upload.numStreams != 1 || upload.hasResult {
+		t.Errorf("Upload: got %+v", upload)
+	}
+	if _, ok := descriptor.methods["onconnected"]; ok {
+		t.Error("OnConnected can be invoked by clients")
+	}
+	if !descriptor.hiddenMethods["onconnected"] {
+		t.Error("OnConnected is not reported as hidden")
+	}
+	if !descriptor.onConnected {
+		t.Error("OnConnected is not detected")
+	}
+}
+
+func TestBuildHubMethodsRejectsInvalidSignatures(t *testing.T) {
+	for _, test := range []struct {
+		hub  hubInterface
+		want string
+	}{
+		{&ctxNotFirstHub{}, "context.Context must be the first parameter"},
+		{&variadicHub{}, "variadic methods are not supported"},
+		{&unexportedParamHub{}, "is not exported"},
+		{&funcParamHub{}, "can't be serialized"},
+		{&interfaceParamHub{}, "can't be deserialized"},
+		{&sendOnlyStreamHub{}, "must return a channel that can be received from"},
+		{&tooManyResultsHub{}, "at most one value and an error"},
+	} {
+		_, err := newHubDescriptor(test.hub)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%T: got error %v, want %q", test.hub, err, test.want)
+		}
+	}
+}
+
+func TestRegisterHubsRejectsEveryHubWhenOneIsInvalid(t *testing.T) {
+	server := &Server{}
+	if err := server.RegisterHubs(&tableHub{}, &variadicHub{}); err == nil {
+		t.Fatal("invalid hub was registered")
+	}
+	if len(server.hubs) != 0 {
+		t.Errorf("got %d registered hubs, want 0", len(server.hubs))
+	}
+}
+
+type ambiguousHub struct{ Hub }
+
+func (h ambiguousHub) Echo(msg string) string { return msg }
+
+func (h ambiguousHub) ECHO(msg string) string { return msg }
+
+func TestBuildHubMethodsResolvesCaseInsensitively(t *testing.T) {
+	methods, _, err := buildHubMethods(&tableHub{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Echo", "echo", "ECHO"} {
+		if method := methods[strings.ToLower(name)]; method == nil || method.name != "Echo" {
+			t.Errorf("%s: got %+v, want Echo", name, method)
+		}
+	}
+}
+
+func TestBuildHubMethodsRejectsAmbiguousNames(t *testing.T) {
+	_, _, err := buildHubMethods(&ambiguousHub{}, Options{})
+	if err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("got error %v, want an ambiguous name", err)
+	}
+	// excluding one of them resolves the ambiguity
+	methods, _, err := buildHubMethods(&ambiguousHub{}, Options{ExcludedMethods: []string{"ECHO"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method := methods["echo"]; method == nil || method.name != "Echo" {
+		t.Errorf("got %+v, want Echo", method)
+	}
+}
+
+func TestBuildHubMethodsAliases(t *testing.T) {
+	methods, _, err := buildHubMethods(&tableHub{}, Options{MethodAliases: map[string]string{"Say": "Echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method := methods["say"]; method == nil || method.name != "Echo" {
+		t.Errorf("alias: got %+v, want Echo", method)
+	}
+	if methods["echo"] == nil {
+		t.Error("aliased method lost its own name")
+	}
+
+	_, _, err = buildHubMethods(&tableHub{}, Options{MethodAliases: map[string]string{"Say": "Missing"}})
+	if err == nil || !strings.Contains(err.Error(), "unknown method") {
+		t.Errorf("alias of a missing method: got error %v", err)
+	}
+	_, _, err = buildHubMethods(&tableHub{}, Options{MethodAliases: map[string]string{"add": "Echo"}})
+	if err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("alias shadowing a method: got error %v", err)
+	}
+}
+
+func TestBuildHubMethodsExclusions(t *testing.T) {
+	methods, hidden, err := buildHubMethods(&tableHub{}, Options{ExcludedMethods: []string{"Add"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := methods["add"]; ok {
+		t.Error("excluded method can be invoked")
+	}
+	if !hidden["add"] {
+		t.Error("excluded method is not reported as hidden")
+	}
+
+	_, _, err = buildHubMethods(&tableHub{}, Options{ExcludedMethods: []string{"Missing"}})
+	if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("exclusion of a missing method: got error %v", err)
+	}
+	_, _, err = buildHubMethods(&tableHub{}, Options{
+		ExcludedMethods: []string{"Echo"},
+		MethodAliases:   map[string]string{"Say": "Echo"},
+	})
+	if err == nil {
+		t.Error("alias of an excluded method was accepted")
+	}
+}
+
+type Greeter struct{}
+
+func (Greeter) Greet(name string) string { return "hello " + name }
+
+type embeddingHub struct {
+	Hub
+	Greeter
+}
+
+func (h embeddingHub) Echo(msg string) string { return msg }
+
+func TestBuildHubMethodsHidesPromotedMethods(t *testing.T) {
+	methods, hidden, err := buildHubMethods(&embeddingHub{}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clients", "abort", "userid", "callercontext", "greet"} {
+		if _, ok := methods[name]; ok {
+			t.Errorf("promoted method %s can be invoked", name)
+		}
+		if !hidden[name] {
+			t.Errorf("promoted method %s is not reported as hidden", name)
+		}
+	}
+	if methods["echo"] == nil {
+		t.Error("declared method Echo is hidden")
+	}
+}
+
+func TestBuildHubMethodsIncludesPromotedMethods(t *testing.T) {
+	methods, hidden, err := buildHubMethods(&embeddingHub{}, Options{IncludedMethods: []string{"Greet"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method := methods["greet"]; method == nil || method.name != "Greet" {
+		t.Errorf("included method: got %+v, want Greet", method)
+	}
+	if hidden["greet"] {
+		t.Error("included method is reported as hidden")
+	}
+	if !hidden["clients"] {
+		t.Error("methods not included are no longer hidden")
+	}
+
+	_, _, err = buildHubMethods(&embeddingHub{}, Options{IncludedMethods: []string{"Echo"}})
+	if err == nil || !strings.Contains(err.Error(), "not promoted") {
+		t.Errorf("inclusion of a declared method: got error %v", err)
+	}
+}
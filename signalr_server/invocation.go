@@ -0,0 +1,286 @@
+package signalr_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// HubError is an error whose message is always sent to the client, no matter
+// whether Options.DetailedErrors is set.
+type HubError struct {
+	Message string
+}
+
+func NewHubError(message string) *HubError {
+	return &HubError{Message: message}
+}
+
+func (e *HubError) Error() string {
+	return e.Message
+}
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+func (ctx *connectionCtx) handleInvocation(hub hubInterface, m Invocation) {
+	hm, ok := ctx.descriptor.methods[strings.ToLower(m.Target)]
+	if !ok && ctx.descriptor.hiddenMethods[strings.ToLower(m.Target)] {
+		ctx.completeWithError(m, NewHubError(fmt.Sprintf("'%s' is not a hub method clients can invoke", m.Target)))
+		return
+	}
+	if !ok {
+		ctx.completeWithError(m, NewHubError(fmt.Sprintf("Unknown hub method '%s'", m.Target)))
+		return
+	}
+	if ctx.descriptor.authorize {
+		if err := hub.(authorizingHub).Authorize(hm.name, ctx.principal); err != nil {
+			LogDebug(fmt.Sprintf("authorization of '%s' failed: %v", m.Target, err))
+			ctx.completeWithError(m, NewHubError(fmt.Sprintf(
+				"Failed to invoke '%s' because user is unauthorized", m.Target)))
+			return
+		}
+	}
+	if m.Type == StreamInvocationType && !hm.isStream {
+		ctx.completeWithError(m, NewHubError(fmt.Sprintf("'%s' is not a stream method", m.Target)))
+		return
+	}
+	if m.Type == InvocationType && hm.isStream {
+		ctx.completeWithError(m, NewHubError(fmt.Sprintf(
+			"The client attempted to invoke the streaming '%s' method with a non-streaming invocation.", m.Target)))
+		return
+	}
+	numArgs := len(hm.paramTypes) - hm.numStreams
+	if numArgs != len(m.Arguments) {
+		ctx.completeWithError(m, NewHubError(fmt.Sprintf(
+			"Failed to invoke '%s'. Invocation provides %d argument(s) but target expects %d.",
+			m.Target, len(m.Arguments), numArgs)))
+		return
+	}
+	if hm.numStreams != len(m.StreamIds) {
+		ctx.completeWithError(m, NewHubError(fmt.Sprintf(
+			"Failed to invoke '%s'. Invocation provides %d stream(s) but target expects %d.",
+			m.Target, len(m.StreamIds), hm.numStreams)))
+		return
+	}
+	values := make([]reflect.Value, len(hm.paramTypes))
+	streams := make([]*clientStream, 0, hm.numStreams)
+	argIndex := 0
+	for i, paramType := range hm.paramTypes {
+		if isStreamParam(paramType) {
+			stream := ctx.openClientStream(m.StreamIds[len(streams)], paramType)
+			streams = append(streams, stream)
+			values[i] = stream.ch.Convert(paramType)
+			continue
+		}
+		bytes := m.Arguments[argIndex].([]byte)
+		v, err := ctx.protocol().unmarshalArgument(bytes, paramType)
+		if err != nil {
+			ctx.closeClientStreams(m.StreamIds[:len(streams)])
+			ctx.completeWithError(m, NewHubError(fmt.Sprintf(
+				"Failed to invoke '%s' due to an error on the server. Argument %d could not be decoded.",
+				m.Target, argIndex)))
+			LogDebug(err)
+			return
+		}
+		values[i] = v
+		argIndex++
+	}
+	// the server stops taking invocations once it is shutting down, so that
+	// Shutdown can wait for the started ones
+	if !ctx.invocations.add() {
+		ctx.closeClientStreams(m.StreamIds)
+		ctx.completeWithError(m, NewHubError("Server is shutting down."))
+		return
+	}
+	invocationCtx, cancel := context.WithCancel(ctx.connectionContext)
+	if m.Type == StreamInvocationType && m.InvocationId != "" {
+		// only stream invocations can be canceled by the client
+		ctx.cancels.Store(m.InvocationId, cancel)
+	}
+	// the method might take very long time. Use another goroutine
+	go func() {
+		defer ctx.invocations.done()
+		defer ctx.releaseClientStreams(m.StreamIds, streams)
+		defer ctx.cancels.Delete(m.InvocationId)
+		defer cancel()
+		ctx.invoke(invocationCtx, hub, hm, values, m)
+	}()
+}
+
+type invocationHeadersKey struct{}
+
+// InvocationHeaders returns the headers the client sent with the invocation
+// the context of a hub method belongs to.
+func InvocationHeaders(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(invocationHeadersKey{}).(map[string]string)
+	return headers
+}
+
+// handleCancelInvocation cancels the context of a stream invocation, which
+// stops reading the channel the stream method returned.
+func (ctx *connectionCtx) handleCancelInvocation(m CancelInvocationMsg) {
+	cancel, ok := ctx.cancels.LoadAndDelete(m.InvocationId)
+	if !ok {
+		LogDebug("no stream invocation to cancel with id " + m.InvocationId)
+		return
+	}
+	cancel.(context.CancelFunc)()
+}
+
+// invoke runs the hub method through the filters. arguments doesn't hold the
+// context parameter of the method, if any.
+func (ctx *connectionCtx) invoke(invocationCtx context.Context, hub hubInterface, hm *hubMethod, arguments []reflect.Value, m Invocation) {
+	// a bug in one hub method must not bring down the server for every client
+	defer func() {
+		if r := recover(); r != nil {
+			ctx.completeWithError(m, recoveredError(m.Target, r))
+		}
+	}()
+	invocation := &HubInvocationContext{
+		Hub:          hub,
+		Target:       hm.name,
+		Arguments:    make([]any, len(arguments)),
+		Headers:      m.Headers,
+		ConnectionId: ctx.connectionId,
+		UserId:       ctx.userId,
+		Principal:    ctx.principal,
+		Caller:       ctx.callerContext,
+	}
+	for i, argument := range arguments {
+		invocation.Arguments[i] = argument.Interface()
+	}
+	if m.Headers != nil {
+		invocationCtx = context.WithValue(invocationCtx, invocationHeadersKey{}, m.Headers)
+	}
+	result, err := ctx.invokeMethodPipeline(invocationCtx, invocation, func(c context.Context, invocation *HubInvocationContext) (any, error) {
+		values := make([]reflect.Value, 0, len(hm.paramTypes)+1)
+		if hm.hasContext {
+			values = append(values, reflect.ValueOf(c))
+		}
+		for i, argument := range invocation.Arguments {
+			if argument == nil {
+				values = append(values, reflect.Zero(hm.paramTypes[i]))
+			} else {
+				values = append(values, reflect.ValueOf(argument))
+			}
+		}
+		response := reflect.ValueOf(hub).Method(hm.index).Call(values)
+		LogDebug(response)
+		return hm.splitResults(response)
+	})
+	if err != nil {
+		ctx.completeWithError(m, err)
+		return
+	}
+	if m.InvocationId == "" {
+		LogDebug("invocationId is empty")
+		return
+	}
+	completeMsg := Completion{
+		Type:         CompletionType,
+		InvocationId: m.InvocationId,
+	}
+	if hm.isStream {
+		v := reflect.ValueOf(result)
+		if v.Kind() != reflect.Chan || v.IsNil() {
+			ctx.completeWithError(m, NewHubError(fmt.Sprintf("'%s' returned no stream", m.Target)))
+			return
+		}
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: v},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(invocationCtx.Done())},
+		}
+		for {
+			chosen, receivedValue, ok := reflect.Select(cases)
+			if chosen == 1 {
+				// canceled by the client or the connection is gone, nobody
+				// is waiting for the completion
+				return
+			}
+			if !ok {
+				break
+			}
+			invocationResult := StreamItem{
+				Type:         StreamItemType,
+				InvocationId: m.InvocationId,
+				Item:         receivedValue.Interface(),
+			}
+			invocationResultBytes, err := ctx.protocol().marshal(invocationResult)
+			if err != nil {
+				completeMsg.Error = ctx.errorMessage(m.Target, err)
+				break
+			}
+			if !ctx.writeResult(invocationCtx, invocationResultBytes) {
+				// canceled or the connection is gone while the client was
+				// catching up
+				return
+			}
+		}
+	} else {
+		completeMsg.Result = result
+	}
+	ctx.sendCompletion(completeMsg)
+}
+
+// splitResults turns the values returned by a hub method into the result sent
+// to the client. A trailing error return value is the failure channel.
+func (hm *hubMethod) splitResults(response []reflect.Value) (any, error) {
+	if hm.returnsError {
+		if errVal := response[len(response)-1]; !errVal.IsNil() {
+			return nil, errVal.Interface().(error)
+		}
+	}
+	if !hm.hasResult {
+		return nil, nil
+	}
+	return response[0].Interface(), nil
+}
+
+// recoveredError logs the stack of a recovered panic and turns it into an error.
+func recoveredError(target string, r any) error {
+	LogError(fmt.Sprintf("panic in hub method '%s': %v\n%s", target, r, debug.Stack()), nil)
+	return fmt.Errorf("panic: %v", r)
+}
+
+// completeWithError reports a failed invocation to the client. Invocations
+// without an id don't expect a completion, so the error is only logged.
+func (ctx *connectionCtx) completeWithError(m Invocation, err error) {
+	LogWarning(fmt.Sprintf("invocation of '%s' failed", m.Target), err)
+	if m.InvocationId == "" {
+		return
+	}
+	ctx.sendCompletion(Completion{
+		Type:         CompletionType,
+		InvocationId: m.InvocationId,
+		Error:        ctx.errorMessage(m.Target, err),
+	})
+}
+
+// errorMessage returns the message the client gets for err. Only HubError
+// messages are sent as is unless DetailedErrors is set.
+func (ctx *connectionCtx) errorMessage(target string, err error) string {
+	var hubErr *HubError
+	if errors.As(err, &hubErr) {
+		return hubErr.Message
+	}
+	message := fmt.Sprintf("An unexpected error occurred invoking '%s' on the server.", target)
+	if ctx.hub.GetOptions().DetailedErrors {
+		message += " " + err.Error()
+	}
+	return message
+}
+
+func (ctx *connectionCtx) sendCompletion(completion Completion) {
+	completionBytes, err := ctx.protocol().marshal(completion)
+	if err != nil {
+		ctx.writeError(err)
+		return
+	}
+	ctx.writeResult(context.Background(), completionBytes)
+}
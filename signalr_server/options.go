@@ -3,4 +3,31 @@ package signalr_server
 type Options struct {
 	PingInterval int // In seconds
 	PingTimeout  int // In seconds
+	// DetailedErrors sends the message of any error returned by a hub method
+	// to the client. Otherwise only HubError messages are sent.
+	DetailedErrors bool
+	// MessagePackStructsAsArrays encodes structs as MessagePack arrays instead
+	// of maps keyed by field name. The .NET client's contractless resolver
+	// expects maps, so only set this for clients using array-keyed contracts.
+	MessagePackStructsAsArrays bool
+	// HubFilters wrap the invocations and lifecycle callbacks of the hub.
+	HubFilters []HubFilter
+	// MethodAliases declares additional names clients can invoke hub methods
+	// with, from alias to Go method name, like [HubMethodName] in .NET. It is
+	// read when the hub is registered.
+	MethodAliases map[string]string
+	// ExcludedMethods lists the exported methods of the hub clients can't
+	// invoke. It is read when the hub is registered.
+	ExcludedMethods []string
+	// IncludedMethods opts in methods promoted from embedded fields, which
+	// clients can't invoke otherwise. It is read when the hub is registered.
+	IncludedMethods []string
+	// OutboundQueueSize bounds the messages waiting to be written to each
+	// connection, 128 when zero.
+	OutboundQueueSize int
+	// OutboundQueuePolicy decides what sending to a connection whose outbound
+	// queue is full does, QueueDisconnect when zero. Stream items and
+	// completions always wait for room.
+	OutboundQueuePolicy  QueuePolicy
+	OutboundQueueTimeout int // In seconds, how long QueueBlock waits, 5 when zero
 }
@@ -2,47 +2,71 @@ package signalr_server
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"github.com/vmihailenco/msgpack/v5"
-	"log"
 	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 type protocol interface {
-	verifyAndRemoveMessageSeparator(bytes []byte) []byte
-	appendMessageSeparator(bytes []byte) []byte
+	verifyAndRemoveMessageSeparator(bytes []byte) ([]byte, error)
+	// splitMessages returns every message of a frame, without separators
+	splitMessages(bytes []byte) ([][]byte, error)
+	appendMessageSeparator(bytes []byte) ([]byte, error)
 	pingMsg() []byte
 	marshal(v any) ([]byte, error)
 	unmarshal([]byte) (any, error)
 	unmarshalArgument([]byte, reflect.Type) (reflect.Value, error)
+	// encoding identifies the wire format, two protocols with equal encodings
+	// produce the same bytes for the same message
+	encoding() any
 }
 
 type jsonProtocol struct {
 }
 
 type msgpackProtocol struct {
+	// arrayEncodedStructs encodes Go structs as arrays instead of maps keyed by
+	// field name, for clients using array-keyed contracts. The .NET
+	// contractless resolver expects maps.
+	arrayEncodedStructs bool
 }
 
 const recordSeparator = '\x1E'
 
+var errRecordSeparatorNotFound = errors.New("record separator not found")
+
 var pingMsgBytes, _ = json.Marshal(PingMsg{Type: 6})
 
-func (p *jsonProtocol) verifyAndRemoveMessageSeparator(bytes []byte) []byte {
-	if bytes[len(bytes)-1] != recordSeparator {
-		log.Fatalln("record separator not found")
+func (p *jsonProtocol) verifyAndRemoveMessageSeparator(bytes []byte) ([]byte, error) {
+	if len(bytes) == 0 || bytes[len(bytes)-1] != recordSeparator {
+		return nil, errRecordSeparatorNotFound
 	}
-	return bytes[:len(bytes)-1]
+	return bytes[:len(bytes)-1], nil
 }
 
-func (p *jsonProtocol) appendMessageSeparator(bytes []byte) []byte {
-	return append(bytes, recordSeparator)
+func (p *jsonProtocol) splitMessages(raw []byte) ([][]byte, error) {
+	raw, err := p.verifyAndRemoveMessageSeparator(raw)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Split(raw, []byte{recordSeparator}), nil
+}
+
+func (p *jsonProtocol) appendMessageSeparator(bytes []byte) ([]byte, error) {
+	return append(bytes, recordSeparator), nil
 }
 
 func (p *jsonProtocol) pingMsg() []byte {
 	return pingMsgBytes
 }
 
+func (p *jsonProtocol) encoding() any {
+	return *p
+}
+
 func (p *jsonProtocol) marshal(v any) ([]byte, error) {
 	return json.Marshal(v)
 }
@@ -66,15 +90,55 @@ func (p *jsonProtocol) unmarshal(raw []byte) (any, error) {
 			Type:         invocationRaw.Type,
 			InvocationId: invocationRaw.InvocationId,
 			Target:       invocationRaw.Target,
+			StreamIds:    invocationRaw.StreamIds,
+			Headers:      invocationRaw.Headers,
 		}
 		for _, arg := range invocationRaw.Arguments {
 			invocation.Arguments = append(invocation.Arguments, []byte(arg))
 		}
 		return invocation, nil
+	case StreamItemType:
+		var streamItemRaw = StreamItemWithJsonRawItem{}
+		err = json.Unmarshal(raw, &streamItemRaw)
+		if err != nil {
+			return nil, err
+		}
+		return StreamItem{
+			Type:         streamItemRaw.Type,
+			InvocationId: streamItemRaw.InvocationId,
+			Item:         []byte(streamItemRaw.Item),
+		}, nil
+	case CompletionType:
+		var completionRaw = CompletionWithJsonRawResult{}
+		err = json.Unmarshal(raw, &completionRaw)
+		if err != nil {
+			return nil, err
+		}
+		completion := Completion{
+			Type:         completionRaw.Type,
+			InvocationId: completionRaw.InvocationId,
+			Error:        completionRaw.Error,
+		}
+		if completionRaw.Result != nil {
+			completion.Result = []byte(completionRaw.Result)
+		}
+		return completion, nil
+	case CancelInvocationType:
+		var cancelInvocation = CancelInvocationMsg{}
+		err = json.Unmarshal(raw, &cancelInvocation)
+		if err != nil {
+			return nil, err
+		}
+		return cancelInvocation, nil
 	case PingType:
 		return PingMsg{Type: PingType}, nil
 	case CloseType:
-		return CloseMsg{Type: CloseType}, nil
+		var closeMsg = CloseMsg{}
+		err = json.Unmarshal(raw, &closeMsg)
+		if err != nil {
+			return nil, err
+		}
+		return closeMsg, nil
 	default:
 		return nil, errors.New("unknown type")
 	}
@@ -86,24 +150,39 @@ func (p *jsonProtocol) unmarshalArgument(raw []byte, t reflect.Type) (reflect.Va
 	return v.Elem(), err
 }
 
-func (p *msgpackProtocol) verifyAndRemoveMessageSeparator(raw []byte) []byte {
-	reader := bytes.NewReader(raw)
-	decoder := msgpack.NewDecoder(reader)
-	var number int
-	if err := decoder.Decode(&number); err != nil {
-		log.Fatal(err)
+// verifyAndRemoveMessageSeparator removes the VarInt length prefix of a
+// message. A prefix longer than 5 bytes is invalid.
+func (p *msgpackProtocol) verifyAndRemoveMessageSeparator(raw []byte) ([]byte, error) {
+	length, n := binary.Uvarint(raw)
+	if n <= 0 || n > 5 {
+		return nil, errors.New("invalid message length prefix")
+	}
+	if uint64(len(raw)-n) < length {
+		return nil, errors.New("incomplete message")
 	}
-	bytesRead := reader.Size() - int64(reader.Len())
-	return raw[bytesRead:]
+	return raw[n : n+int(length)], nil
 }
 
-func (p *msgpackProtocol) appendMessageSeparator(raw []byte) []byte {
-	prefix, err := msgpack.Marshal(len(raw))
-	if err != nil {
-		log.Fatal(err)
+func (p *msgpackProtocol) splitMessages(raw []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(raw) > 0 {
+		msg, err := p.verifyAndRemoveMessageSeparator(raw)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+		_, n := binary.Uvarint(raw)
+		raw = raw[n+len(msg):]
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("empty frame")
 	}
-	result := append(prefix, raw...)
-	return result
+	return messages, nil
+}
+
+func (p *msgpackProtocol) appendMessageSeparator(raw []byte) ([]byte, error) {
+	result := binary.AppendUvarint(make([]byte, 0, len(raw)+5), uint64(len(raw)))
+	return append(result, raw...), nil
 }
 
 var pingMsgBytesMsgpack = []byte{0x91, 0x06}
@@ -112,45 +191,69 @@ func (p *msgpackProtocol) pingMsg() []byte {
 	return pingMsgBytesMsgpack
 }
 
+func (p *msgpackProtocol) encoding() any {
+	return *p
+}
+
+func (p *msgpackProtocol) encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.UseArrayEncodedStructs(p.arrayEncodedStructs)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return make(map[string]string)
+	}
+	return headers
+}
+
+func msgpackInvocationId(invocationId string) any {
+	if invocationId == "" {
+		return nil
+	}
+	return invocationId
+}
+
 func (p *msgpackProtocol) marshal(v any) ([]byte, error) {
 	switch m := v.(type) {
 	case PingMsg:
 		return pingMsgBytesMsgpack, nil
 	case Invocation:
-		var result = make([]any, 6)
-		result[0] = m.Type
-		result[1] = make(map[string]string)
-		if m.InvocationId != "" {
-			result[2] = m.InvocationId
-		}
-		result[3] = m.Target
-		if len(m.Arguments) > 0 {
-			result[4] = m.Arguments
-		} else {
-			result[4] = make([]any, 0)
-		}
-		result[5] = make([]string, 0)
-		return msgpack.Marshal(result)
+		arguments := m.Arguments
+		if arguments == nil {
+			arguments = make([]any, 0)
+		}
+		streamIds := m.StreamIds
+		if streamIds == nil {
+			streamIds = make([]string, 0)
+		}
+		return p.encode([]any{m.Type, msgpackHeaders(m.Headers), msgpackInvocationId(m.InvocationId), m.Target, arguments, streamIds})
+	case StreamItem:
+		return p.encode([]any{m.Type, msgpackHeaders(nil), m.InvocationId, m.Item})
 	case Completion:
-		var result = make([]any, 5)
-		result[0] = m.Type
-		result[1] = make(map[string]string)
-		if m.InvocationId != "" {
-			result[2] = m.InvocationId
+		result := []any{m.Type, msgpackHeaders(nil), m.InvocationId}
+		switch {
+		case m.Error != "":
+			result = append(result, 1, m.Error)
+		case m.Result == nil:
+			result = append(result, 2)
+		default:
+			result = append(result, 3, m.Result)
 		}
+		return p.encode(result)
+	case CancelInvocationMsg:
+		return p.encode([]any{m.Type, msgpackHeaders(nil), m.InvocationId})
+	case CloseMsg:
+		var closeError any
 		if m.Error != "" {
-			result[3] = 1
-			result[4] = m.Error
-		} else {
-			if m.Result == nil {
-				result[3] = 2
-				result = result[:5]
-			} else {
-				result[3] = 3
-				result[4] = m.Result
-			}
+			closeError = m.Error
 		}
-		return msgpack.Marshal(result)
+		return p.encode([]any{m.Type, closeError, m.AllowReconnect})
 	default:
 		return nil, errors.New("unknown type")
 	}
@@ -174,14 +277,14 @@ func (p *msgpackProtocol) unmarshal(raw []byte) (any, error) {
 	case StreamInvocationType:
 		fallthrough
 	case InvocationType:
-		if len(base) != 6 {
+		// the stream ids are missing in messages of older clients
+		if len(base) != 5 && len(base) != 6 {
 			return nil, errors.New("invalid invocation message")
 		}
 		var invocation = Invocation{
 			Type: t,
 		}
-		var headers map[string]string
-		if err := msgpack.Unmarshal(base[1], &headers); err != nil {
+		if err := msgpack.Unmarshal(base[1], &invocation.Headers); err != nil {
 			return nil, err
 		}
 		if base[2] != nil {
@@ -196,16 +299,85 @@ func (p *msgpackProtocol) unmarshal(raw []byte) (any, error) {
 		if err := msgpack.Unmarshal(base[4], &arguments); err != nil {
 			return nil, err
 		}
-		var streamIds []string
-		if err := msgpack.Unmarshal(base[5], &streamIds); err != nil {
-			return nil, err
+		if len(base) == 6 {
+			if err := msgpack.Unmarshal(base[5], &invocation.StreamIds); err != nil {
+				return nil, err
+			}
 		}
 		for _, argument := range arguments {
 			invocation.Arguments = append(invocation.Arguments, []byte(argument))
 		}
 		return invocation, nil
+	case StreamItemType:
+		if len(base) != 4 {
+			return nil, errors.New("invalid stream item message")
+		}
+		var streamItem = StreamItem{
+			Type: t,
+			Item: []byte(base[3]),
+		}
+		if err := msgpack.Unmarshal(base[2], &streamItem.InvocationId); err != nil {
+			return nil, err
+		}
+		return streamItem, nil
+	case CompletionType:
+		if len(base) < 4 {
+			return nil, errors.New("invalid completion message")
+		}
+		var completion = Completion{
+			Type: t,
+		}
+		if err := msgpack.Unmarshal(base[2], &completion.InvocationId); err != nil {
+			return nil, err
+		}
+		var resultKind int
+		if err := msgpack.Unmarshal(base[3], &resultKind); err != nil {
+			return nil, err
+		}
+		switch resultKind {
+		case 1:
+			if len(base) < 5 {
+				return nil, errors.New("invalid completion message")
+			}
+			if err := msgpack.Unmarshal(base[4], &completion.Error); err != nil {
+				return nil, err
+			}
+		case 3:
+			if len(base) < 5 {
+				return nil, errors.New("invalid completion message")
+			}
+			completion.Result = []byte(base[4])
+		}
+		return completion, nil
+	case CancelInvocationType:
+		if len(base) != 3 {
+			return nil, errors.New("invalid cancel invocation message")
+		}
+		var cancelInvocation = CancelInvocationMsg{
+			Type: t,
+		}
+		if err := msgpack.Unmarshal(base[2], &cancelInvocation.InvocationId); err != nil {
+			return nil, err
+		}
+		return cancelInvocation, nil
 	case PingType:
 		return PingMsg{Type: PingType}, nil
+	case CloseType:
+		var closeMsg = CloseMsg{
+			Type: t,
+		}
+		// the error is nil when the connection closed without one
+		if len(base) > 1 && base[1] != nil {
+			if err := msgpack.Unmarshal(base[1], &closeMsg.Error); err != nil {
+				return nil, err
+			}
+		}
+		if len(base) > 2 {
+			if err := msgpack.Unmarshal(base[2], &closeMsg.AllowReconnect); err != nil {
+				return nil, err
+			}
+		}
+		return closeMsg, nil
 	default:
 		return nil, errors.New("unknown type")
 	}
@@ -0,0 +1,191 @@
+package signalr_server
+
+import (
+	"reflect"
+	"testing"
+)
+
+type protocolPoint struct {
+	X int
+	Y string
+}
+
+// roundTrip frames msg the way it goes on the wire and reads it back.
+func roundTrip(t *testing.T, p protocol, msg any) any {
+	t.Helper()
+	raw, err := p.marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal %T: %v", msg, err)
+	}
+	frame, err := p.appendMessageSeparator(raw)
+	if err != nil {
+		t.Fatalf("frame %T: %v", msg, err)
+	}
+	messages, err := p.splitMessages(frame)
+	if err != nil {
+		t.Fatalf("split %T: %v", msg, err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("split %T: got %d messages, want 1", msg, len(messages))
+	}
+	decoded, err := p.unmarshal(messages[0])
+	if err != nil {
+		t.Fatalf("unmarshal %T: %v", msg, err)
+	}
+	return decoded
+}
+
+func decodeArgument[T any](t *testing.T, p protocol, raw any) T {
+	t.Helper()
+	v, err := p.unmarshalArgument(raw.([]byte), reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		t.Fatalf("unmarshal argument: %v", err)
+	}
+	return v.Interface().(T)
+}
+
+func msgpackProtocols() map[string]protocol {
+	return map[string]protocol{
+		"maps":   &msgpackProtocol{},
+		"arrays": &msgpackProtocol{arrayEncodedStructs: true},
+	}
+}
+
+func TestMsgpackInvocationRoundTrip(t *testing.T) {
+	for name, p := range msgpackProtocols() {
+		t.Run(name, func(t *testing.T) {
+			for _, invocationType := range []int{InvocationType, StreamInvocationType} {
+				sent := Invocation{
+					Type:         invocationType,
+					Headers:      map[string]string{"trace": "abc"},
+					InvocationId: "7",
+					Target:       "Send",
+					Arguments:    []any{"hello", 42, protocolPoint{X: 1, Y: "y"}},
+					StreamIds:    []string{"s1"},
+				}
+				got, ok := roundTrip(t, p, sent).(Invocation)
+				if !ok {
+					t.Fatalf("got %T, want Invocation", got)
+				}
+				if got.Type != sent.Type || got.InvocationId != "7" || got.Target != "Send" {
+					t.Errorf("got %+v, want %+v", got, sent)
+				}
+				if !reflect.DeepEqual(got.Headers, sent.Headers) {
+					t.Errorf("headers: got %v, want %v", got.Headers, sent.Headers)
+				}
+				if !reflect.DeepEqual(got.StreamIds, sent.StreamIds) {
+					t.Errorf("stream ids: got %v, want %v", got.StreamIds, sent.StreamIds)
+				}
+				if len(got.Arguments) != 3 {
+					t.Fatalf("got %d arguments, want 3", len(got.Arguments))
+				}
+				if s := decodeArgument[string](t, p, got.Arguments[0]); s != "hello" {
+					t.Errorf("argument 0: got %q", s)
+				}
+				if i := decodeArgument[int](t, p, got.Arguments[1]); i != 42 {
+					t.Errorf("argument 1: got %d", i)
+				}
+				if point := decodeArgument[protocolPoint](t, p, got.Arguments[2]); point != (protocolPoint{X: 1, Y: "y"}) {
+					t.Errorf("argument 2: got %+v", point)
+				}
+			}
+		})
+	}
+}
+
+func TestMsgpackInvocationWithoutIdRoundTrip(t *testing.T) {
+	got := roundTrip(t, &msgpackProtocol{}, Invocation{Type: InvocationType, Target: "Notify"}).(Invocation)
+	if got.InvocationId != "" || got.Target != "Notify" || len(got.Arguments) != 0 || len(got.StreamIds) != 0 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMsgpackStreamItemRoundTrip(t *testing.T) {
+	p := &msgpackProtocol{}
+	got := roundTrip(t, p, StreamItem{Type: StreamItemType, InvocationId: "3", Item: 12}).(StreamItem)
+	if got.InvocationId != "3" {
+		t.Errorf("invocation id: got %q", got.InvocationId)
+	}
+	if item := decodeArgument[int](t, p, got.Item); item != 12 {
+		t.Errorf("item: got %d", item)
+	}
+}
+
+func TestMsgpackCompletionRoundTrip(t *testing.T) {
+	p := &msgpackProtocol{}
+
+	withError := roundTrip(t, p, Completion{Type: CompletionType, InvocationId: "1", Error: "boom"}).(Completion)
+	if withError.InvocationId != "1" || withError.Error != "boom" || withError.Result != nil {
+		t.Errorf("error completion: got %+v", withError)
+	}
+
+	void := roundTrip(t, p, Completion{Type: CompletionType, InvocationId: "2"}).(Completion)
+	if void.InvocationId != "2" || void.Error != "" || void.Result != nil {
+		t.Errorf("void completion: got %+v", void)
+	}
+
+	withResult := roundTrip(t, p, Completion{Type: CompletionType, InvocationId: "3", Result: "done"}).(Completion)
+	if withResult.InvocationId != "3" || withResult.Error != "" {
+		t.Errorf("result completion: got %+v", withResult)
+	}
+	if result := decodeArgument[string](t, p, withResult.Result); result != "done" {
+		t.Errorf("result: got %q", result)
+	}
+}
+
+func TestMsgpackCancelInvocationRoundTrip(t *testing.T) {
+	got := roundTrip(t, &msgpackProtocol{}, CancelInvocationMsg{Type: CancelInvocationType, InvocationId: "9"})
+	if got != (CancelInvocationMsg{Type: CancelInvocationType, InvocationId: "9"}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMsgpackPingRoundTrip(t *testing.T) {
+	got := roundTrip(t, &msgpackProtocol{}, PingMsg{Type: PingType})
+	if got != (PingMsg{Type: PingType}) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestMsgpackCloseRoundTrip(t *testing.T) {
+	for _, sent := range []CloseMsg{
+		{Type: CloseType},
+		{Type: CloseType, Error: "Server is shutting down.", AllowReconnect: true},
+	} {
+		if got := roundTrip(t, &msgpackProtocol{}, sent); got != sent {
+			t.Errorf("got %+v, want %+v", got, sent)
+		}
+	}
+}
+
+func TestMsgpackSplitsEveryMessageOfAFrame(t *testing.T) {
+	p := &msgpackProtocol{}
+	var frame []byte
+	for _, msg := range []any{PingMsg{Type: PingType}, CancelInvocationMsg{Type: CancelInvocationType, InvocationId: "4"}} {
+		raw, err := p.marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		framed, _ := p.appendMessageSeparator(raw)
+		frame = append(frame, framed...)
+	}
+	messages, err := p.splitMessages(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(messages))
+	}
+	if msg, _ := p.unmarshal(messages[1]); msg != (CancelInvocationMsg{Type: CancelInvocationType, InvocationId: "4"}) {
+		t.Errorf("second message: got %+v", msg)
+	}
+}
+
+func TestMsgpackRejectsIncompleteFrame(t *testing.T) {
+	p := &msgpackProtocol{}
+	raw, _ := p.marshal(PingMsg{Type: PingType})
+	frame, _ := p.appendMessageSeparator(raw)
+	if _, err := p.splitMessages(frame[:len(frame)-1]); err == nil {
+		t.Error("incomplete frame was accepted")
+	}
+}
@@ -0,0 +1,296 @@
+package signalr_server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// QueuePolicy decides what sending to a connection does when its outbound
+// queue is full. It applies to Send and broadcasts only: the results of the
+// caller's own invocations, stream items and completions, always wait for
+// room, which holds the invoking goroutine back until the client catches up
+// or the connection ends.
+type QueuePolicy int
+
+const (
+	// QueueDisconnect closes the connection of the slow consumer. It is the
+	// default, so that no sender ever waits on a client.
+	QueueDisconnect QueuePolicy = iota
+	// QueueDropOldest drops the oldest queued message to make room. Queued
+	// results are never dropped, the new message is when only results are left.
+	QueueDropOldest
+	// QueueBlock waits up to Options.OutboundQueueTimeout for room in the
+	// queue, then fails the send. Send and broadcasts wait on each full queue
+	// in turn, prefer SendAsync with it.
+	QueueBlock
+)
+
+const (
+	defaultOutboundQueueSize    = 128
+	defaultOutboundQueueTimeout = 5 * time.Second
+)
+
+var (
+	errOutboundQueueTimeout = errors.New("timed out waiting for room in the outbound queue")
+	errOutboundQueueFull    = errors.New("outbound queue is full")
+	errSlowConsumer         = &closeError{reason: "Connection closed because the client is not reading messages fast enough.", allowReconnect: true}
+)
+
+// QueueMetrics describes the outbound queue of a connection.
+type QueueMetrics struct {
+	// Depth is the number of messages waiting to be written.
+	Depth int
+	// MaxDepth is the highest Depth the queue reached.
+	MaxDepth int
+	// Capacity is the number of messages the queue holds.
+	Capacity int
+	// Dropped counts the messages dropped by QueueDropOldest.
+	Dropped int64
+}
+
+// queuedFrame is a framed message waiting in the outbound queue. result marks
+// the stream items and completions, which QueueDropOldest keeps.
+type queuedFrame struct {
+	data   []byte
+	result bool
+}
+
+// outboundQueue holds the framed messages of a connection until its write pump
+// hands them to the transport, so that senders never wait on the client.
+type outboundQueue struct {
+	lock     sync.Mutex
+	frames   []queuedFrame
+	capacity int
+	policy   QueuePolicy
+	timeout  time.Duration
+	closed   bool
+	maxDepth int
+	dropped  int64
+	// notEmpty and notFull wake the pump and a blocked sender
+	notEmpty chan struct{}
+	notFull  chan struct{}
+	// done is closed with the queue, drained when the pump is done writing
+	done    chan struct{}
+	drained chan struct{}
+}
+
+func newOutboundQueue(options Options) *outboundQueue {
+	q := &outboundQueue{
+		capacity: options.OutboundQueueSize,
+		policy:   options.OutboundQueuePolicy,
+		timeout:  time.Duration(options.OutboundQueueTimeout) * time.Second,
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+	if q.capacity <= 0 {
+		q.capacity = defaultOutboundQueueSize
+	}
+	if q.timeout <= 0 {
+		q.timeout = defaultOutboundQueueTimeout
+	}
+	return q
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// push queues frame, applying the policy of the queue when it is full.
+func (q *outboundQueue) push(c context.Context, frame []byte) error {
+	return q.pushFrame(c, frame, true)
+}
+
+// tryPush is push failing with errOutboundQueueFull instead of waiting for
+// room under QueueBlock.
+func (q *outboundQueue) tryPush(frame []byte) error {
+	return q.pushFrame(context.Background(), frame, false)
+}
+
+// pushResult queues the result of an invocation whatever the policy, waiting
+// for room until the queue is closed or c is done.
+func (q *outboundQueue) pushResult(c context.Context, frame []byte) error {
+	q.lock.Lock()
+	for len(q.frames) >= q.capacity {
+		if q.closed {
+			q.lock.Unlock()
+			return errConnectionEnded
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.notFull:
+		case <-q.done:
+		case <-c.Done():
+			return c.Err()
+		}
+		q.lock.Lock()
+	}
+	return q.appendLocked(queuedFrame{data: frame, result: true})
+}
+
+// appendLocked queues frame and releases the lock taken by the caller. notFull
+// holds a single wakeup, so it is passed on while there is room left for
+// another waiting sender.
+func (q *outboundQueue) appendLocked(frame queuedFrame) error {
+	if q.closed {
+		q.lock.Unlock()
+		return errConnectionEnded
+	}
+	q.frames = append(q.frames, frame)
+	if len(q.frames) > q.maxDepth {
+		q.maxDepth = len(q.frames)
+	}
+	room := len(q.frames) < q.capacity
+	q.lock.Unlock()
+	signal(q.notEmpty)
+	if room {
+		signal(q.notFull)
+	}
+	return nil
+}
+
+// dropOldestLocked drops the oldest frame that isn't a result and reports
+// whether there was one.
+func (q *outboundQueue) dropOldestLocked() bool {
+	for i, frame := range q.frames {
+		if frame.result {
+			continue
+		}
+		copy(q.frames[i:], q.frames[i+1:])
+		q.frames[len(q.frames)-1] = queuedFrame{}
+		q.frames = q.frames[:len(q.frames)-1]
+		q.dropped++
+		return true
+	}
+	return false
+}
+
+func (q *outboundQueue) pushFrame(c context.Context, frame []byte, wait bool) error {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	q.lock.Lock()
+	for {
+		if q.closed {
+			q.lock.Unlock()
+			return errConnectionEnded
+		}
+		if len(q.frames) < q.capacity {
+			return q.appendLocked(queuedFrame{data: frame})
+		}
+		switch q.policy {
+		case QueueDropOldest:
+			if q.dropOldestLocked() {
+				continue
+			}
+			q.dropped++
+			q.lock.Unlock()
+			return nil
+		case QueueDisconnect:
+			q.lock.Unlock()
+			return errSlowConsumer
+		}
+		q.lock.Unlock()
+		if !wait {
+			return errOutboundQueueFull
+		}
+		if timer == nil {
+			timer = time.NewTimer(q.timeout)
+		}
+		select {
+		case <-q.notFull:
+		case <-q.done:
+		case <-timer.C:
+			return errOutboundQueueTimeout
+		case <-c.Done():
+			return c.Err()
+		}
+		q.lock.Lock()
+	}
+}
+
+// pop takes the oldest frame, waiting for one. It returns false once the queue
+// is closed and empty.
+func (q *outboundQueue) pop() ([]byte, bool) {
+	q.lock.Lock()
+	for len(q.frames) == 0 {
+		if q.closed {
+			q.lock.Unlock()
+			return nil, false
+		}
+		q.lock.Unlock()
+		select {
+		case <-q.notEmpty:
+		case <-q.done:
+		}
+		q.lock.Lock()
+	}
+	frame := q.frames[0]
+	q.frames[0] = queuedFrame{}
+	q.frames = q.frames[1:]
+	q.lock.Unlock()
+	signal(q.notFull)
+	return frame.data, true
+}
+
+// close stops the queue from taking frames. The pump still writes the queued
+// ones.
+func (q *outboundQueue) close() {
+	q.closeWith(nil)
+}
+
+// closeWith closes the queue with frame as its last message, whatever room is
+// left, and reports whether it was queued.
+func (q *outboundQueue) closeWith(frame []byte) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	if frame != nil {
+		q.frames = append(q.frames, queuedFrame{data: frame, result: true})
+	}
+	q.closed = true
+	close(q.done)
+	return true
+}
+
+func (q *outboundQueue) metrics() QueueMetrics {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return QueueMetrics{
+		Depth:    len(q.frames),
+		MaxDepth: q.maxDepth,
+		Capacity: q.capacity,
+		Dropped:  q.dropped,
+	}
+}
+
+// writePump is the only writer of the transport once the handshake is done.
+// It stops at the first transport error, which ends the connection. drained is
+// closed before the error is reported, as waitError may be waiting on it in
+// sendClose instead of reading eCh.
+func (ctx *connectionCtx) writePump() {
+	for {
+		frame, ok := ctx.outbound.pop()
+		if !ok {
+			close(ctx.outbound.drained)
+			return
+		}
+		if err := ctx.conn.send(frame); err != nil {
+			ctx.outbound.close()
+			close(ctx.outbound.drained)
+			ctx.writeError(err)
+			return
+		}
+	}
+}
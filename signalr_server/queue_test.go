@@ -0,0 +1,191 @@
+package signalr_server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var queuePolicies = map[string]QueuePolicy{
+	"disconnect":  QueueDisconnect,
+	"drop oldest": QueueDropOldest,
+	"block":       QueueBlock,
+}
+
+// fillQueue queues size messages sent to the client, as by Send.
+func fillQueue(t *testing.T, q *outboundQueue, size int) {
+	t.Helper()
+	for i := 0; i < size; i++ {
+		if err := q.tryPush([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueDisconnectRefusesSendWhenFull(t *testing.T) {
+	q := newOutboundQueue(Options{OutboundQueueSize: 2})
+	fillQueue(t, q, 2)
+	if err := q.push(context.Background(), []byte("x")); err != errSlowConsumer {
+		t.Errorf("got %v, want errSlowConsumer", err)
+	}
+}
+
+func TestQueueDropOldestKeepsResults(t *testing.T) {
+	q := newOutboundQueue(Options{OutboundQueueSize: 3, OutboundQueuePolicy: QueueDropOldest})
+	q.pushResult(context.Background(), []byte("completion"))
+	fillQueue(t, q, 2)
+	if err := q.push(context.Background(), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for q.metrics().Depth > 0 {
+		frame, _ := q.pop()
+		got = append(got, string(frame))
+	}
+	if strings.Join(got, ",") != "completion,\x01,new" {
+		t.Errorf("got %q, want the completion, the second message and the new one", got)
+	}
+
+	// with only results queued, the new message is the one dropped
+	for i := 0; i < 3; i++ {
+		q.pushResult(context.Background(), []byte("item"))
+	}
+	if err := q.push(context.Background(), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if m := q.metrics(); m.Depth != 3 || m.Dropped != 2 {
+		t.Errorf("got %+v, want 3 queued results and 2 dropped messages", m)
+	}
+}
+
+func TestQueueBlockTimesOutSend(t *testing.T) {
+	q := newOutboundQueue(Options{OutboundQueueSize: 1, OutboundQueuePolicy: QueueBlock, OutboundQueueTimeout: 1})
+	fillQueue(t, q, 1)
+	if err := q.tryPush([]byte("x")); err != errOutboundQueueFull {
+		t.Errorf("tryPush: got %v, want errOutboundQueueFull", err)
+	}
+	c, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.push(c, []byte("x")); err != context.DeadlineExceeded {
+		t.Errorf("push: got %v, want the context error", err)
+	}
+}
+
+func TestQueueResultsWaitForRoomWhateverThePolicy(t *testing.T) {
+	for name, policy := range queuePolicies {
+		t.Run(name, func(t *testing.T) {
+			q := newOutboundQueue(Options{OutboundQueueSize: 1, OutboundQueuePolicy: policy})
+			fillQueue(t, q, 1)
+			pushed := make(chan error, 1)
+			go func() { pushed <- q.pushResult(context.Background(), []byte("item")) }()
+			select {
+			case err := <-pushed:
+				t.Fatalf("result was not held back by the full queue: %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+			q.pop()
+			if err := <-pushed; err != nil {
+				t.Fatal(err)
+			}
+			if frame, _ := q.pop(); string(frame) != "item" {
+				t.Errorf("got %q, want the result", frame)
+			}
+
+			fillQueue(t, q, 1)
+			go func() { pushed <- q.pushResult(context.Background(), []byte("item")) }()
+			q.close()
+			if err := <-pushed; err != errConnectionEnded {
+				t.Errorf("closed queue: got %v, want errConnectionEnded", err)
+			}
+		})
+	}
+}
+
+// slowConnection takes a while to write each frame, like a client reading
+// slowly or a long polling one.
+type slowConnection struct {
+	lock   sync.Mutex
+	frames []string
+	sent   chan struct{}
+}
+
+func (c *slowConnection) send(frame []byte) error {
+	time.Sleep(100 * time.Microsecond)
+	c.lock.Lock()
+	c.frames = append(c.frames, string(frame))
+	c.lock.Unlock()
+	c.sent <- struct{}{}
+	return nil
+}
+
+func (c *slowConnection) read() ([]byte, error) { select {} }
+
+type queueStreamHub struct {
+	Hub
+}
+
+func (h queueStreamHub) Count(n int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			ch <- i
+		}
+	}()
+	return ch
+}
+
+func TestStreamLongerThanTheQueue(t *testing.T) {
+	const items = 1000
+	for name, policy := range queuePolicies {
+		t.Run(name, func(t *testing.T) {
+			hub := &queueStreamHub{}
+			descriptor, err := newHubDescriptor(hub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &slowConnection{sent: make(chan struct{}, items+1)}
+			ctx := &connectionCtx{
+				connectionId: "stream",
+				conn:         conn,
+				hub:          hub,
+				end:          make(chan any),
+				eCh:          make(chan error, 1),
+				invocations:  &invocationTracker{},
+				descriptor:   descriptor,
+				outbound:     newOutboundQueue(Options{OutboundQueueSize: 4, OutboundQueuePolicy: policy}),
+			}
+			var prtl protocol = &jsonProtocol{}
+			ctx.prtl.Store(&prtl)
+			ctx.connectionContext, ctx.cancelConnection = context.WithCancel(context.Background())
+			defer ctx.cancelConnection()
+			go ctx.writePump()
+
+			ctx.handleInvocation(hub, Invocation{
+				Type:         StreamInvocationType,
+				InvocationId: "1",
+				Target:       "Count",
+				Arguments:    []any{[]byte("1000")},
+			})
+			for i := 0; i < items+1; i++ {
+				select {
+				case <-conn.sent:
+				case err := <-ctx.eCh:
+					t.Fatalf("connection ended after %d messages: %v", i, err)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("got %d messages, want %d", i, items+1)
+				}
+			}
+			conn.lock.Lock()
+			defer conn.lock.Unlock()
+			if !strings.Contains(conn.frames[items-1], `"item":999`) {
+				t.Errorf("last item: got %s", conn.frames[items-1])
+			}
+			if !strings.Contains(conn.frames[items], `"type":3`) {
+				t.Errorf("got %s, want the completion last", conn.frames[items])
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package signalr_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var errConnectionEnded = errors.New("connection closed")
+
+// SendError reports the connections an invocation could not be delivered to,
+// keyed by connection id.
+type SendError struct {
+	Failures map[string]error
+}
+
+func (e *SendError) Error() string {
+	ids := make([]string, 0, len(e.Failures))
+	for id := range e.Failures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	failures := make([]string, 0, len(ids))
+	for _, id := range ids {
+		failures = append(failures, fmt.Sprintf("%s: %v", id, e.Failures[id]))
+	}
+	return fmt.Sprintf("failed to send to %d connection(s): %s", len(ids), strings.Join(failures, "; "))
+}
+
+// invocationFrames serializes an invocation once per protocol encoding and
+// keeps the framed bytes for the connections speaking it.
+type invocationFrames struct {
+	invocation Invocation
+	frames     map[any][]byte
+	errs       map[any]error
+}
+
+func newInvocationFrames(method string, args []any) *invocationFrames {
+	return &invocationFrames{
+		invocation: Invocation{
+			Type:      InvocationType,
+			Target:    method,
+			Arguments: args,
+		},
+		frames: make(map[any][]byte),
+		errs:   make(map[any]error),
+	}
+}
+
+func (f *invocationFrames) frame(prtl protocol) ([]byte, error) {
+	encoding := prtl.encoding()
+	if err, ok := f.errs[encoding]; ok {
+		return nil, err
+	}
+	if frame, ok := f.frames[encoding]; ok {
+		return frame, nil
+	}
+	msg, err := prtl.marshal(f.invocation)
+	if err == nil {
+		msg, err = prtl.appendMessageSeparator(msg)
+	}
+	if err != nil {
+		f.errs[encoding] = err
+		return nil, err
+	}
+	f.frames[encoding] = msg
+	return msg, nil
+}
+
+// broadcast sends an invocation to every connection visited by forEach. The
+// invocation is serialized once per protocol encoding and the framed bytes are
+// shared by all the connections speaking it.
+func broadcast(forEach func(func(*connectionCtx)), method string, args []any) {
+	LogDebug("invoke clients")
+	frames := newInvocationFrames(method, args)
+	logged := false
+	forEach(func(client *connectionCtx) {
+		prtl := client.protocol()
+		if prtl == nil {
+			return
+		}
+		frame, err := frames.frame(prtl)
+		if err != nil {
+			if !logged {
+				LogError("failed to marshal invocation of "+method, err)
+				logged = true
+			}
+			return
+		}
+		client.writeFrame(frame)
+	})
+}
+
+// broadcastAsync is broadcast for SendAsync. Every invocation is marshalled
+// before the first one is queued, and no connection is waited on: a full
+// queue fails its own connection, with errOutboundQueueFull under QueueBlock.
+func broadcastAsync(ctx context.Context, forEach func(func(*connectionCtx)), method string, args []any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	frames := newInvocationFrames(method, args)
+	var clients []*connectionCtx
+	var clientFrames [][]byte
+	var marshalErr error
+	forEach(func(client *connectionCtx) {
+		prtl := client.protocol()
+		if prtl == nil || marshalErr != nil {
+			return
+		}
+		frame, err := frames.frame(prtl)
+		if err != nil {
+			marshalErr = err
+			return
+		}
+		clients = append(clients, client)
+		clientFrames = append(clientFrames, frame)
+	})
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	failures := make(map[string]error)
+	for i, client := range clients {
+		if err := ctx.Err(); err != nil {
+			failures[client.connectionId] = err
+			continue
+		}
+		if err := client.tryFrame(clientFrames[i]); err != nil {
+			failures[client.connectionId] = err
+		}
+	}
+	if len(failures) > 0 {
+		return &SendError{Failures: failures}
+	}
+	return nil
+}
+
+// SendAsync queues an invocation to the connection and returns when it is
+// queued, the outbound queue policy failed it, the connection closed or ctx
+// is done.
+func (ctx *connectionCtx) SendAsync(c context.Context, method string, args ...any) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	prtl := ctx.protocol()
+	if prtl == nil {
+		return errors.New("connection has not completed the handshake")
+	}
+	frame, err := newInvocationFrames(method, args).frame(prtl)
+	if err != nil {
+		return err
+	}
+	return ctx.sendFrame(c, frame)
+}
@@ -1,51 +1,196 @@
 package signalr_server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"reflect"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type Server struct {
-	hubs []hubInterface
+	// Authenticator authenticates negotiate and hub requests. Anyone can
+	// connect when it is nil.
+	Authenticator Authenticator
+	// UserIdProvider derives the user id of a connection. The user id of the
+	// principal is used when it is nil.
+	UserIdProvider UserIdProvider
+	// HubFilters wrap the invocations and lifecycle callbacks of every hub,
+	// around the filters of the hub itself.
+	HubFilters  []HubFilter
+	hubs        []*hubDescriptor
+	handler     http.Handler
+	handlerOnce sync.Once
+	httpServer  *http.Server
+	lock        sync.Mutex
+	closing     atomic.Bool
+	invocations invocationTracker
+}
+
+// invocationTracker counts the running hub invocations. Unlike a
+// sync.WaitGroup, it refuses new invocations once it is waited on.
+type invocationTracker struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	running int
+	closed  bool
+}
+
+// add reports whether an invocation may start.
+func (t *invocationTracker) add() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.running++
+	return true
+}
+
+func (t *invocationTracker) done() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.running--
+	if t.running == 0 && t.cond != nil {
+		t.cond.Broadcast()
+	}
+}
+
+// closeAndWait refuses new invocations and waits for the running ones.
+func (t *invocationTracker) closeAndWait() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	if t.cond == nil {
+		t.cond = sync.NewCond(&t.lock)
+	}
+	for t.running > 0 {
+		t.cond.Wait()
+	}
 }
 
 type handlerContext struct {
-	hub hubInterface
+	*hubDescriptor
+	server *Server
 }
 
-func (s *Server) RegisterHubs(hubs ...hubInterface) {
-	s.hubs = append(s.hubs, hubs...)
+var (
+	errServerShutdown     = errors.New("server is shutting down")
+	errConnectionIdEmpty  = errors.New("connectionId is empty")
+	errConnectionNotFound = errors.New("connection not found")
+)
+
+// negotiateTimeout bounds how long the token of a negotiated connection stays
+// valid without the connection being started, like the disconnect timeout of
+// .NET.
+const negotiateTimeout = 15 * time.Second
+
+// RegisterHubs validates the hubs and builds their method tables. No hub is
+// registered when any of them is invalid.
+func (s *Server) RegisterHubs(hubs ...hubInterface) error {
+	descriptors := make([]*hubDescriptor, 0, len(hubs))
+	for _, hub := range hubs {
+		descriptor, err := newHubDescriptor(hub)
+		if err != nil {
+			return err
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	s.hubs = append(s.hubs, descriptors...)
+	return nil
 }
 
 func (s *Server) BindHubs(handle func(pattern string, handler func(http.ResponseWriter, *http.Request))) {
-	for _, hub := range s.hubs {
-		hubVal := reflect.ValueOf(hub)
-		if hubVal.Kind() == reflect.Ptr && !hubVal.IsNil() {
-			hubName := reflect.Indirect(reflect.ValueOf(hub)).Type().Name()
-			hubName = strings.ToLower(hubName)
-			hub.init(CreateDefaultClients())
-			hc := handlerContext{hub: hub}
-			handle("/"+hubName+"/negotiate", hc.negotiate)
-			handle("/"+hubName, hc.handler)
-		} else {
-			LogFatal("hub is invalid", nil)
-		}
+	for _, descriptor := range s.hubs {
+		hubName := strings.ToLower(descriptor.name)
+		descriptor.clients = CreateDefaultClients()
+		descriptor.hub.init(descriptor.clients)
+		hc := handlerContext{hubDescriptor: descriptor, server: s}
+		handle("/"+hubName+"/negotiate", hc.negotiate)
+		handle("/"+hubName, hc.handler)
 	}
 }
 
+// Handler returns an http.Handler serving all registered hubs, so they can be
+// mounted in any router. The hubs are bound only once.
+func (s *Server) Handler() http.Handler {
+	s.handlerOnce.Do(func() {
+		mux := http.NewServeMux()
+		s.BindHubs(mux.HandleFunc)
+		s.handler = mux
+	})
+	return s.handler
+}
+
 func (s *Server) Start() {
-	s.BindHubs(http.HandleFunc)
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
+	err := s.ListenAndServe(":8080")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		LogError("ListenAndServe: ", err)
 	}
 }
 
+func (s *Server) ListenAndServe(addr string) error {
+	return s.newHttpServer(addr).ListenAndServe()
+}
+
+func (s *Server) ListenAndServeTLS(addr string, certFile string, keyFile string) error {
+	return s.newHttpServer(addr).ListenAndServeTLS(certFile, keyFile)
+}
+
+func (s *Server) newHttpServer(addr string) *http.Server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.httpServer = &http.Server{Addr: addr, Handler: s.Handler()}
+	return s.httpServer
+}
+
+// Shutdown stops accepting negotiations, sends a Close message to every
+// connection and waits for in-flight hub invocations to drain before
+// shutting down the underlying http server, if any. The http server is closed
+// at once when ctx is done first, and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	for _, descriptor := range s.hubs {
+		if descriptor.clients == nil {
+			continue
+		}
+		// abort waits up to closeMessageTimeout for the Close message to be
+		// written, slow clients must not hold back the others
+		descriptor.clients.forEachConnection(func(c *connectionCtx) {
+			go c.abort("Server is shutting down.", true)
+		})
+	}
+
+	drained := make(chan any)
+	go func() {
+		s.invocations.closeAndWait()
+		close(drained)
+	}()
+	s.lock.Lock()
+	httpServer := s.httpServer
+	s.lock.Unlock()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		return ctx.Err()
+	}
+	if httpServer != nil {
+		return httpServer.Shutdown(ctx)
+	}
+	return nil
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -55,10 +200,27 @@ var upgrader = websocket.Upgrader{
 }
 
 func (hc handlerContext) negotiate(w http.ResponseWriter, r *http.Request) {
-	// always return negotiation version 0
+	if hc.server.closing.Load() {
+		http.Error(w, errServerShutdown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := hc.authenticate(w, r); !ok {
+		return
+	}
+	// version 1 hands out a secret connection token, distinct from the public
+	// connection id, which the transports use to address the connection
+	negotiateVersion, _ := strconv.Atoi(r.URL.Query().Get("negotiateVersion"))
+	if negotiateVersion > 1 {
+		negotiateVersion = 1
+	}
+	connectionId := uuid.NewString()
+	connectionToken := connectionId
+	if negotiateVersion >= 1 {
+		connectionToken = uuid.NewString()
+	}
 	negotiationResponse := &NegotiateResponse{
-		ConnectionId:     uuid.NewString(),
-		NegotiateVersion: 0,
+		ConnectionId:     connectionId,
+		NegotiateVersion: negotiateVersion,
 		AvailableTransports: []TransportDescription{
 			{
 				Transport:       "WebSockets",
@@ -74,69 +236,98 @@ func (hc handlerContext) negotiate(w http.ResponseWriter, r *http.Request) {
 			},
 		},
 	}
+	if negotiateVersion >= 1 {
+		negotiationResponse.ConnectionToken = connectionToken
+	}
 	responseBytes, err := json.Marshal(negotiationResponse)
 	if err != nil {
 		LogError("", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	hc.connectionTokens.Store(connectionToken, connectionId)
+	// a started connection deletes its token when it closes
+	time.AfterFunc(negotiateTimeout, func() {
+		if hc.hub.Clients().getConnection(connectionId) == nil {
+			hc.connectionTokens.Delete(connectionToken)
+		}
+	})
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(responseBytes)
 }
 
 func (hc handlerContext) handler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := hc.authenticate(w, r)
+	if !ok {
+		return
+	}
 	switch r.Method {
 	case "POST":
-		connectionId := r.URL.Query().Get("id")
-		if connectionId == "" {
-			LogFatal("connectionId is empty", nil)
+		connectionId, ok := hc.connectionIdFromToken(w, r)
+		if !ok {
+			return
 		}
 		ctx := hc.hub.Clients().getConnection(connectionId)
 		if ctx == nil {
-			LogFatal("connection not found", nil)
+			http.Error(w, errConnectionNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if !checkPrincipal(w, ctx, principal) {
+			return
 		}
 		con, ok := ctx.conn.(postDrivenConnection)
 		if !ok {
-			LogFatal("connection type error", nil)
+			http.Error(w, "POST requests are not allowed for websocket connections", http.StatusBadRequest)
+			return
 		}
 		err := con.readFromRequest(r, ctx.end)
 		if err != nil {
+			http.Error(w, "failed to read the request body", http.StatusBadRequest)
 			ctx.writeError(err)
 		}
 	case "GET":
 		protocol := checkProtocol(r)
 		switch protocol {
 		case LongPolling:
-			hc.handleLongPolling(w, r)
+			hc.handleLongPolling(w, r, principal)
 		case ServerSentEvents:
-			hc.handleServerSentEvents(w, r)
+			hc.handleServerSentEvents(w, r, principal)
 		case WebSocket:
-			hc.HandleWebSocket(w, r)
+			hc.HandleWebSocket(w, r, principal)
 		default:
-			LogFatal("protocol not supported", nil)
+			http.Error(w, "protocol not supported", http.StatusBadRequest)
 		}
 	default:
-		LogFatal("method not supported", nil)
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not supported: "+r.Method, http.StatusMethodNotAllowed)
 	}
 }
 
-func (hc handlerContext) handleServerSentEvents(w http.ResponseWriter, r *http.Request) {
-	connectionId := r.URL.Query().Get("id")
-	if connectionId == "" {
-		LogFatal("connectionId is empty", nil)
+func (hc handlerContext) handleServerSentEvents(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	connectionId, ok := hc.connectionIdFromToken(w, r)
+	if !ok {
+		return
 	}
 
 	ctx := hc.hub.Clients().getConnection(connectionId)
 	if ctx == nil {
+		// Check if the ResponseWriter supports flushing
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
 		sseC := &serverSentEventsConnection{
 			postDrivenConnectionImp: postDrivenConnectionImp{
 				fromHub: make(chan []byte),
 				toHub:   make(chan []byte),
 			},
 		}
-		hub := shallowCopyHubInterface(hc.hub)
-		hub.setContext(r.Context())
-		ctx = initConnectionCtx(connectionId, sseC, hub)
+		if hc.server.closing.Load() {
+			http.Error(w, errServerShutdown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		ctx = hc.newConnectionCtx(connectionId, r.URL.Query().Get("id"), sseC, r, principal)
 		sseC.end = ctx.end
 		ctx.start()
 		go ctx.waitError()
@@ -144,25 +335,20 @@ func (hc handlerContext) handleServerSentEvents(w http.ResponseWriter, r *http.R
 		w.Header().Set("Cache-Control", "no-cache")
 		w.WriteHeader(http.StatusOK)
 		//w.Write([]byte("\r\n"))
-		// Check if the ResponseWriter supports flushing
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			LogFatal("Streaming unsupported!", nil)
-		}
 		flusher.Flush()
 		err := sseC.keepFlushing(flusher, w, ctx.end)
 		if err != nil {
 			ctx.writeError(err)
 		}
 	} else {
-		LogFatal("sse connection reconnect", nil)
+		http.Error(w, "connection already has an active event stream", http.StatusConflict)
 	}
 }
 
-func (hc handlerContext) handleLongPolling(w http.ResponseWriter, r *http.Request) {
-	connectionId := r.URL.Query().Get("id")
-	if connectionId == "" {
-		LogFatal("connectionId is empty", nil)
+func (hc handlerContext) handleLongPolling(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	connectionId, ok := hc.connectionIdFromToken(w, r)
+	if !ok {
+		return
 	}
 
 	ctx := hc.hub.Clients().getConnection(connectionId)
@@ -173,16 +359,22 @@ func (hc handlerContext) handleLongPolling(w http.ResponseWriter, r *http.Reques
 				toHub:   make(chan []byte),
 			},
 		}
-		hub := shallowCopyHubInterface(hc.hub)
-		hub.setContext(r.Context())
-		ctx = initConnectionCtx(connectionId, lpc, hub)
+		if hc.server.closing.Load() {
+			http.Error(w, errServerShutdown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		ctx = hc.newConnectionCtx(connectionId, r.URL.Query().Get("id"), lpc, r, principal)
 		lpc.end = ctx.end
 		ctx.start()
 		go ctx.waitError()
 	} else {
+		if !checkPrincipal(w, ctx, principal) {
+			return
+		}
 		lpc, success := ctx.conn.(*longPollingConnection)
 		if !success {
-			LogFatal("connection type error", nil)
+			http.Error(w, "connection is not a long polling connection", http.StatusBadRequest)
+			return
 		}
 		err := lpc.waitAndFlush(w, ctx.end)
 		if err != nil {
@@ -193,7 +385,25 @@ func (hc handlerContext) handleLongPolling(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func (hc handlerContext) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+func (hc handlerContext) HandleWebSocket(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	if hc.server.closing.Load() {
+		http.Error(w, errServerShutdown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// clients skipping negotiation connect without a token
+	connectionToken := r.URL.Query().Get("id")
+	connectionId := uuid.NewString()
+	if connectionToken != "" {
+		var ok bool
+		connectionId, ok = hc.connectionIdFromToken(w, r)
+		if !ok {
+			return
+		}
+		if hc.hub.Clients().getConnection(connectionId) != nil {
+			http.Error(w, "connection is already active", http.StatusConflict)
+			return
+		}
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		LogError("Upgrade error", err)
@@ -201,15 +411,81 @@ func (hc handlerContext) HandleWebSocket(w http.ResponseWriter, r *http.Request)
 	}
 	defer conn.Close()
 
-	connectionId := r.URL.Query().Get("id")
 	wsc := &webSocketConnection{ws: conn}
-	hub := shallowCopyHubInterface(hc.hub)
-	hub.setContext(r.Context())
-	ctx := initConnectionCtx(connectionId, wsc, hub)
+	ctx := hc.newConnectionCtx(connectionId, connectionToken, wsc, r, principal)
 	ctx.start()
 	ctx.waitError()
 }
 
+// newConnectionCtx creates the context of a new connection with its own copy of
+// the hub, so we don't modify the template hub.
+func (hc handlerContext) newConnectionCtx(connectionId string, connectionToken string, conn connection, r *http.Request, principal *Principal) *connectionCtx {
+	hub := shallowCopyHubInterface(hc.hub)
+	hub.setPrincipal(principal)
+	userId := hc.server.userId(r, principal)
+	hub.setUserId(userId)
+	ctx := initConnectionCtx(r.Context(), connectionId, conn, hub, hc)
+	hub.setContext(ctx.connectionContext)
+	ctx.userId = userId
+	ctx.connectionToken = connectionToken
+	ctx.principal = principal
+	ctx.callerContext = &HubCallerContext{
+		ConnectionId:      connectionId,
+		UserId:            userId,
+		Principal:         principal,
+		Headers:           callerHeaders(r),
+		Query:             callerQuery(r),
+		RemoteAddr:        r.RemoteAddr,
+		Transport:         transportName(conn),
+		ConnectionAborted: ctx.connectionContext,
+	}
+	hub.setCallerContext(ctx.callerContext)
+	return ctx
+}
+
+// callerHeaders returns the headers of a request without the bearer token,
+// which hubs must not see.
+func callerHeaders(r *http.Request) http.Header {
+	headers := r.Header.Clone()
+	headers.Del("Authorization")
+	return headers
+}
+
+// callerQuery returns the query string of a request without the connection
+// token and the bearer token, which hubs must not see.
+func callerQuery(r *http.Request) url.Values {
+	query := r.URL.Query()
+	query.Del("id")
+	query.Del("access_token")
+	return query
+}
+
+// checkPrincipal replies 403 when the user of a request is not the user the
+// connection was created by.
+func checkPrincipal(w http.ResponseWriter, ctx *connectionCtx, principal *Principal) bool {
+	if principalUserId(ctx.principal) != principalUserId(principal) {
+		http.Error(w, "the user identity cannot change during an active connection", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// connectionIdFromToken resolves the connection token sent as ?id= to the
+// public connection id handed out with it by negotiate.
+func (hc handlerContext) connectionIdFromToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	connectionToken := r.URL.Query().Get("id")
+	if connectionToken == "" {
+		http.Error(w, errConnectionIdEmpty.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	connectionId, ok := hc.connectionTokens.Load(connectionToken)
+	if !ok {
+		http.Error(w, errConnectionNotFound.Error(), http.StatusNotFound)
+		return "", false
+	}
+	return connectionId.(string), true
+}
+
 func checkProtocol(r *http.Request) transportProtocol {
 	connectionHeader := strings.ToLower(r.Header.Get("Connection"))
 	upgradeHeader := strings.ToLower(r.Header.Get("Upgrade"))
@@ -0,0 +1,57 @@
+package signalr_server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesHttpServerWhenContextExpires(t *testing.T) {
+	server := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe("127.0.0.1:0") }()
+	for {
+		server.lock.Lock()
+		started := server.httpServer != nil
+		server.lock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// an invocation that never returns
+	server.invocations.add()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the context error", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("http server stopped with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("http server is still serving")
+	}
+}
+
+func TestCallerContextHidesTokens(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/hub?id=token&access_token=secret&room=lobby", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("User-Agent", "test")
+	headers := callerHeaders(r)
+	if headers.Get("Authorization") != "" || headers.Get("User-Agent") != "test" {
+		t.Errorf("got headers %v", headers)
+	}
+	if r.Header.Get("Authorization") == "" {
+		t.Error("the headers of the request were changed")
+	}
+	if query := callerQuery(r); query.Encode() != "room=lobby" {
+		t.Errorf("got query %q, want room=lobby", query.Encode())
+	}
+}
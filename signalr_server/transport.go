@@ -3,7 +3,6 @@ package signalr_server
 import (
 	"io"
 	"net/http"
-	"sync"
 
 	"github.com/gorilla/websocket"
 )
@@ -13,21 +12,35 @@ type connection interface {
 	read() ([]byte, error)
 }
 
+// transportName returns the name negotiate uses for the transport of conn.
+func transportName(conn connection) string {
+	switch conn.(type) {
+	case *webSocketConnection:
+		return "WebSockets"
+	case *serverSentEventsConnection:
+		return "ServerSentEvents"
+	case *longPollingConnection:
+		return "LongPolling"
+	}
+	return ""
+}
+
+// webSocketConnection is written to by the handshake, then by the write pump
+// of the connection only, as gorilla websocket doesn't support concurrent
+// writes.
 type webSocketConnection struct {
 	ws          *websocket.Conn
 	messageType int
-	lock        sync.Mutex
 }
 
 func (c *webSocketConnection) send(msg []byte) error {
 	if msg == nil {
 		return nil
 	}
-	// This is anti pattern. It should be put into a goroutine to do send
-	// gorilla websocket doesn't support concurrent send. It will panic
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	// todo: rethink this
+	if c.messageType != 0 {
+		return c.ws.WriteMessage(c.messageType, msg)
+	}
+	// the handshake response is sent before the message type is known
 	if msg[len(msg)-1] == recordSeparator {
 		return c.ws.WriteMessage(websocket.TextMessage, msg)
 	} else {
@@ -36,11 +49,28 @@ func (c *webSocketConnection) send(msg []byte) error {
 
 }
 
+// setBinary sets the frame type used once the hub protocol is negotiated, as a
+// binary message may well end with a record separator. It is called before the
+// write pump starts.
+func (c *webSocketConnection) setBinary(binary bool) {
+	if binary {
+		c.messageType = websocket.BinaryMessage
+	} else {
+		c.messageType = websocket.TextMessage
+	}
+}
+
 func (c *webSocketConnection) read() ([]byte, error) {
 	_, p, err := c.ws.ReadMessage()
 	return p, err
 }
 
+// closedByClient reports whether a read failed because the client closed its
+// WebSocket normally.
+func closedByClient(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
 type postDrivenConnection interface {
 	connection
 	readFromRequest(r *http.Request, end chan any) error
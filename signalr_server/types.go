@@ -9,6 +9,7 @@ const (
 	StreamItemType       = 2
 	CompletionType       = 3
 	StreamInvocationType = 4
+	CancelInvocationType = 5
 	PingType             = 6
 	CloseType            = 7
 )
@@ -23,6 +24,7 @@ const (
 
 type NegotiateResponse struct {
 	ConnectionId        string                 `json:"connectionId"`
+	ConnectionToken     string                 `json:"connectionToken,omitempty"`
 	NegotiateVersion    int                    `json:"negotiateVersion"`
 	AvailableTransports []TransportDescription `json:"availableTransports"`
 }
@@ -49,22 +51,33 @@ type PingMsg struct {
 	Type int `json:"type"`
 }
 
+type CancelInvocationMsg struct {
+	Type         int    `json:"type"`
+	InvocationId string `json:"invocationId"`
+}
+
 type CloseMsg struct {
-	Type int `json:"type"`
+	Type           int    `json:"type"`
+	Error          string `json:"error,omitempty"`
+	AllowReconnect bool   `json:"allowReconnect,omitempty"`
 }
 
 type Invocation struct {
-	Type         int    `json:"type"`
-	InvocationId string `json:"invocationId,omitempty"`
-	Target       string `json:"target"`
-	Arguments    []any  `json:"arguments"`
+	Type         int               `json:"type"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	InvocationId string            `json:"invocationId,omitempty"`
+	Target       string            `json:"target"`
+	Arguments    []any             `json:"arguments"`
+	StreamIds    []string          `json:"streamIds,omitempty"`
 }
 
 type InvocationWithJsonRawArguments struct {
 	Type         int               `json:"type"`
+	Headers      map[string]string `json:"headers,omitempty"`
 	InvocationId string            `json:"invocationId"`
 	Target       string            `json:"target"`
 	Arguments    []json.RawMessage `json:"arguments"`
+	StreamIds    []string          `json:"streamIds,omitempty"`
 }
 
 type Completion struct {
@@ -74,8 +87,21 @@ type Completion struct {
 	Error        string `json:"error,omitempty"`
 }
 
+type CompletionWithJsonRawResult struct {
+	Type         int             `json:"type"`
+	InvocationId string          `json:"invocationId"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
 type StreamItem struct {
 	Type         int    `json:"type"`
 	InvocationId string `json:"invocationId"`
 	Item         any    `json:"item"`
 }
+
+type StreamItemWithJsonRawItem struct {
+	Type         int             `json:"type"`
+	InvocationId string          `json:"invocationId"`
+	Item         json.RawMessage `json:"item"`
+}